@@ -0,0 +1,52 @@
+// Command audit-verify checks the hash chains of audit logs written by the file or stdout sinks.
+// Files are read in the order given, so rotated files must be listed from the oldest:
+//
+//	audit-verify -key /run/secrets/audit_key audit.log.2 audit.log.1 audit.log
+//
+// The key file holds the audit key of the service. Without file arguments the log is read
+// from standard input.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/audit"
+	"github.com/GregoryKogan/jwt-microservice/pkg/secrets"
+)
+
+func main() {
+	keyPath := flag.String("key", secrets.Path("audit_key"), "file holding the audit key")
+	flag.Parse()
+
+	key, err := os.ReadFile(*keyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var input io.Reader = os.Stdin
+	if flag.NArg() > 0 {
+		readers := make([]io.Reader, 0, flag.NArg())
+		for _, path := range flag.Args() {
+			file, err := os.Open(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			defer file.Close()
+			readers = append(readers, file)
+		}
+		input = io.MultiReader(readers...)
+	}
+
+	count, err := audit.Verify(input, []byte(strings.TrimSpace(string(key))))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verification failed after %d events: %v\n", count, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d events verified\n", count)
+}
@@ -1,21 +1,52 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"slices"
+	"syscall"
+	"time"
 
+	"github.com/GregoryKogan/jwt-microservice/pkg/audit"
 	"github.com/GregoryKogan/jwt-microservice/pkg/auth"
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/dpop"
 	"github.com/GregoryKogan/jwt-microservice/pkg/cache"
 	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/health"
 	"github.com/GregoryKogan/jwt-microservice/pkg/logging"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/GregoryKogan/jwt-microservice/pkg/mtls"
+	authv1 "github.com/GregoryKogan/jwt-microservice/pkg/pb/auth/v1"
 	"github.com/GregoryKogan/jwt-microservice/pkg/ping"
+	"github.com/GregoryKogan/jwt-microservice/pkg/ratelimit"
+	"github.com/GregoryKogan/jwt-microservice/pkg/server"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tracing"
+	"github.com/redis/go-redis/v9"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpchealth "google.golang.org/grpc/health"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 func main() {
 	config.Init()
 	logging.Init()
+	defer logging.Sync()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	maxProcs := viper.GetInt("server.max_processors")
 	if maxProcs > 0 {
@@ -23,35 +54,310 @@ func main() {
 		slog.Info("Processor configuration", slog.Int("max_procs", maxProcs), slog.Int("system_logical_procs", runtime.NumCPU()))
 	}
 
+	slog.Info("Initializing tracing")
+	shutdownTracing, err := tracing.Init(ctx)
+	if err != nil {
+		slog.Error("Failed to initialize tracing", slog.Any("error", err))
+		panic(err)
+	}
+
 	mux := http.NewServeMux()
 
 	slog.Info("Initializing cache connection")
 	cache := cache.InitCacheConnection()
 
+	slog.Info("Initializing audit log")
+	shutdownAudit, err := audit.Init(cache)
+	if err != nil {
+		slog.Error("Failed to initialize audit log", slog.Any("error", err))
+		panic(err)
+	}
+
+	slog.Info("Initializing tenants")
+	tenants, err := tenant.NewRegistry()
+	if err != nil {
+		slog.Error("Failed to initialize tenants", slog.Any("error", err))
+		panic(err)
+	}
+
 	slog.Info("Initializing repositories")
 	authRepo := auth.NewAuthRepo(cache)
 
 	slog.Info("Initializing services")
 	authService := auth.NewAuthService(authRepo)
 
+	slog.Info("Initializing TLS")
+	tlsConfig, err := server.NewTLSConfig()
+	if err != nil {
+		slog.Error("Failed to initialize TLS", slog.Any("error", err))
+		panic(err)
+	}
+
+	trustedProxies, err := server.TrustedProxies()
+	if err != nil {
+		slog.Error("Failed to parse trusted proxies", slog.Any("error", err))
+		panic(err)
+	}
+	certProxies, err := mtls.ParsePrefixes(viper.GetStringSlice("server.tls.forwarded_cert.trusted_proxies"))
+	if err != nil {
+		slog.Error("Failed to parse trusted proxies", slog.Any("error", err))
+		panic(err)
+	}
+
 	slog.Info("Initializing handlers")
-	authHandler := auth.NewAuthHandler(authService)
+	authHandler := auth.NewAuthHandler(authService, tenants, dpop.NewVerifier(authRepo))
 	pingHandler := ping.NewPingHandler()
+	healthHandler := health.NewHealthHandler(
+		health.CacheCheck(cache),
+		health.SigningKeyCheck(tenants.All()),
+	)
+
+	limits, err := newRateLimits(cache, authHandler)
+	if err != nil {
+		slog.Error("Failed to initialize rate limits", slog.Any("error", err))
+		panic(err)
+	}
+	route := func(name string, handler http.HandlerFunc) http.Handler {
+		return newRoute(name, handler, limits(name))
+	}
 
 	slog.Info("Registering routes")
-	mux.HandleFunc("/ping", pingHandler.Ping)
-	mux.HandleFunc("/login", authHandler.Login)
-	mux.HandleFunc("/refresh", authHandler.Refresh)
-	mux.HandleFunc("/logout", authHandler.Logout)
-	mux.HandleFunc("/authenticate", authHandler.Authenticate)
+	mux.Handle("/ping", route("ping", pingHandler.Ping))
+	// Probes are not traced or counted, they would drown out real traffic
+	mux.HandleFunc("/livez", healthHandler.Livez)
+	mux.HandleFunc("/readyz", healthHandler.Readyz)
+	metricsServer := setupMetrics(mux, authRepo, tenants)
+	prefixes := []string{""}
+	if prefix := tenants.PathPrefix(); prefix != "" {
+		prefixes = append(prefixes, prefix)
+	}
+	for _, prefix := range prefixes {
+		mux.Handle(prefix+"/login", route("login", authHandler.Login))
+		mux.Handle(prefix+"/refresh", route("refresh", authHandler.Refresh))
+		mux.Handle(prefix+"/logout", route("logout", authHandler.Logout))
+		mux.Handle(prefix+"/authenticate", route("authenticate", authHandler.Authenticate))
+		mux.Handle(prefix+"/forward-auth", route("forward-auth", authHandler.ForwardAuth))
+		mux.Handle(prefix+"/token-exchange", route("token-exchange", authHandler.TokenExchange))
+	}
 
-	port := viper.GetString("server.port")
+	handler := middleware.Chain(mux,
+		middleware.RequestID(),
+		middleware.ClientIP(trustedProxies),
+		audit.Middleware(),
+		mtls.Identify(),
+		mtls.IdentifyForwarded(config.StringOrDefault("server.tls.forwarded_cert.header", "X-Client-Cert"), certProxies),
+		middleware.AccessLog(),
+		middleware.Recover(),
+		middleware.MaxBodySize(int64(viper.GetSizeInBytes("server.max_body_size"))),
+	)
+
+	serveErrors := make(chan error, 3)
+
+	var grpcServer *grpc.Server
+	if viper.GetBool("grpc.enabled") {
+		grpcServer = newGRPCServer(auth.NewAuthGRPCServer(authService, tenants), tlsConfig)
+		go func() {
+			serveErrors <- serveGRPC(grpcServer)
+		}()
+	}
+
+	httpServer := server.NewHTTPServer(handler)
+	httpServer.TLSConfig = tlsConfig
 	slog.Info("Starting server",
-		slog.String("port", port),
+		slog.String("port", viper.GetString("server.port")),
+		slog.Bool("tls", tlsConfig != nil),
 		slog.String("log_level", viper.GetString("logging.level")),
 	)
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			serveErrors <- err
+		}
+	}()
+
+	if metricsServer != nil {
+		slog.Info("Starting metrics server", slog.String("addr", metricsServer.Addr))
+		go func() {
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serveErrors <- err
+			}
+		}()
+	}
+
+	// A server that failed is reported through the exit code once the others have drained
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("Received termination signal, shutting down")
+	case serveErr = <-serveErrors:
+		slog.Error("Server failed, shutting down", slog.Any("error", serveErr))
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), server.ShutdownTimeout())
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to drain HTTP connections", slog.Any("error", err))
+	}
+	if grpcServer != nil {
+		stopGRPC(shutdownCtx, grpcServer)
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Failed to stop metrics server", slog.Any("error", err))
+		}
+	}
+	if err := authRepo.Close(shutdownCtx); err != nil {
+		slog.Error("Failed to write pending session extensions", slog.Any("error", err))
+	}
+	if err := shutdownAudit(shutdownCtx); err != nil {
+		slog.Error("Failed to write pending audit events", slog.Any("error", err))
+	}
+	if err := cache.Close(); err != nil {
+		slog.Error("Failed to close cache connection", slog.Any("error", err))
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", slog.Any("error", err))
+	}
+	if serveErr != nil {
+		slog.Error("Server stopped after a failure")
+		cancel()
+		logging.Sync()
+		os.Exit(1) // deferred calls do not run, they are done above
+	}
+	slog.Info("Server stopped")
+}
+
+// newRoute applies the handler timeout of a route, falling back to the default handler timeout,
+// and requires a client certificate when the route is listed in server.tls.client_auth_routes.
+// Requests are traced and, with metrics enabled, counted under the name of the route, including
+// those rejected by its rate limits.
+func newRoute(name string, handler http.HandlerFunc, limit middleware.Middleware) http.Handler {
+	var wrapped http.Handler = handler
+
+	timeout := viper.GetDuration("server.route_timeouts." + name)
+	if timeout == 0 {
+		timeout = viper.GetDuration("server.handler_timeout")
+	}
+	if timeout > 0 {
+		wrapped = middleware.Timeout(timeout)(wrapped)
+	}
+
+	if slices.Contains(viper.GetStringSlice("server.tls.client_auth_routes"), name) {
+		wrapped = mtls.Require()(wrapped)
+	}
+	wrapped = limit(wrapped)
+	if viper.GetBool("metrics.enabled") {
+		wrapped = metrics.Instrument(name)(wrapped)
+	}
+	return tracing.Middleware(name)(wrapped)
+}
+
+// newRateLimits returns the rate limiting middleware of every route. Routes without rules,
+// and every route unless rate_limit.enabled is set, are not limited.
+func newRateLimits(cache *redis.Client, authHandler auth.AuthHandler) (func(route string) middleware.Middleware, error) {
+	var rules map[string][]ratelimit.Rule
+	if viper.GetBool("rate_limit.enabled") {
+		var err error
+		if rules, err = ratelimit.NewRules(); err != nil {
+			return nil, err
+		}
+	}
+
+	limiter := ratelimit.NewLimiter(cache)
+	keys := map[string]ratelimit.KeyFunc{
+		ratelimit.KeyIP:     ratelimit.ClientIP,
+		ratelimit.KeyUser:   authHandler.RateLimitSubject,
+		ratelimit.KeyClient: ratelimit.Client,
+	}
+	return func(route string) middleware.Middleware {
+		return ratelimit.Middleware(limiter, route, rules[route], keys)
+	}, nil
+}
+
+// setupMetrics registers the collectors that read application state and serves the metrics,
+// on the main mux or on a separate server when metrics.port is set. It returns the separate server, if any.
+func setupMetrics(mux *http.ServeMux, authRepo auth.AuthRepo, tenants tenant.Registry) *http.Server {
+	if !viper.GetBool("metrics.enabled") {
+		return nil
+	}
+
+	interval := viper.GetDuration("metrics.session_count_interval")
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	metrics.Registry.MustRegister(
+		metrics.NewSessionCollector(authRepo, tenants.All(), interval),
+		metrics.NewKeyRingCollector(tenants.All()),
+	)
+
+	path := config.StringOrDefault("metrics.path", "/metrics")
+	port := viper.GetString("metrics.port")
+	if port == "" {
+		mux.Handle(path, metrics.Handler())
+		return nil
+	}
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle(path, metrics.Handler())
+	return &http.Server{
+		Addr:              ":" + port,
+		Handler:           metricsMux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+func newGRPCServer(authServer authv1.AuthServiceServer, tlsConfig *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(audit.UnaryServerInterceptor()),
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(options...)
+	authv1.RegisterAuthServiceServer(server, authServer)
+
+	healthServer := grpchealth.NewServer()
+	healthServer.SetServingStatus(authv1.AuthService_ServiceDesc.ServiceName, healthgrpc.HealthCheckResponse_SERVING)
+	healthgrpc.RegisterHealthServer(server, healthServer)
+
+	if viper.GetBool("grpc.reflection") {
+		reflection.Register(server)
+	}
+	return server
+}
+
+func serveGRPC(server *grpc.Server) error {
+	port := viper.GetString("grpc.port")
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Starting gRPC server", slog.String("port", port))
+	return server.Serve(listener)
+}
+
+// stopGRPC waits for in-flight RPCs to finish and cancels them once the shutdown deadline expires.
+func stopGRPC(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
 
-	if err := http.ListenAndServe(":"+port, mux); err != nil {
-		slog.Error("Failed to start server", slog.Any("error", err))
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		slog.Warn("gRPC drain deadline exceeded, cancelling remaining calls")
+		server.Stop()
 	}
 }
@@ -0,0 +1,303 @@
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Types of events.
+const (
+	TypeLogin          = "login"
+	TypeRefresh        = "refresh"
+	TypeLogout         = "logout"
+	TypeRevocation     = "revocation"     // a single exchanged token was revoked
+	TypeAuthentication = "authentication" // only failed authentications are recorded
+	TypeExchange       = "token_exchange"
+	TypeImpersonation  = "impersonation" // a token exchange without a subject token
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event is an entry of the audit log. The schema is fixed: every field is present in the
+// serialized event, empty when unknown.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Tenant    string    `json:"tenant"`
+	Subject   string    `json:"subject"`
+	Session   string    `json:"session"` // UID of the token presented, or issued at login
+	Actor     string    `json:"actor"`   // actor of a token exchange
+	Scope     string    `json:"scope"`   // scope granted by a token exchange
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason"` // error code of a failure
+	RequestID string    `json:"request_id"`
+
+	// Every instance writes its own chain, in which each event carries the hash of the
+	// previous one, so that modified, removed or reordered events can be detected.
+	Chain    string `json:"chain"`
+	Sequence uint64 `json:"seq"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// ComputeHash returns the hex-encoded HMAC-SHA256 under key of the event serialized with an
+// empty hash. Without the key, events cannot be rewritten along with the rest of their chain.
+func (e Event) ComputeHash(key []byte) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+type Logger interface {
+	// Record completes event with the request in ctx, links it into the chain and queues it
+	// for the sinks. It does not wait for the sinks.
+	Record(ctx context.Context, event Event)
+	// Close writes the queued events and closes the sinks.
+	Close(ctx context.Context) error
+}
+
+// LoggerImpl writes events to its sinks from a single goroutine, in the order of the chain.
+// When the queue is full, events are dropped rather than slowing down requests. A dropped
+// event still takes its place in the chain, so the gap shows when the chain is verified.
+type LoggerImpl struct {
+	sinks   []Sink
+	timeout time.Duration
+	queue   chan []byte
+	done    chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	key      []byte
+	chain    string
+	sequence uint64
+	prevHash string
+}
+
+// NewLogger creates a logger chaining events with HMACs under key.
+func NewLogger(sinks []Sink, key []byte, queueSize int, timeout time.Duration) Logger {
+	l := &LoggerImpl{
+		sinks:   sinks,
+		key:     key,
+		timeout: timeout,
+		queue:   make(chan []byte, queueSize),
+		done:    make(chan struct{}),
+		chain:   uuid.New().String(),
+	}
+	go l.run()
+	return l
+}
+
+func (l *LoggerImpl) Record(ctx context.Context, event Event) {
+	event.Time = time.Now().UTC()
+	if req, ok := ctx.Value(requestKey{}).(Request); ok {
+		event.ClientIP, event.UserAgent, event.RequestID = req.ClientIP, req.UserAgent, req.RequestID
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+
+	l.sequence++
+	event.Chain, event.Sequence, event.PrevHash = l.chain, l.sequence, l.prevHash
+	hash, err := event.ComputeHash(l.key)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to hash audit event", slog.Any("error", err))
+		return
+	}
+	event.Hash = hash
+	l.prevHash = hash
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode audit event", slog.Any("error", err))
+		return
+	}
+
+	select {
+	case l.queue <- line:
+		metrics.AuditEvents.WithLabelValues(metrics.AuditQueued).Inc()
+	default:
+		metrics.AuditEvents.WithLabelValues(metrics.AuditDropped).Inc()
+		slog.ErrorContext(ctx, "Dropped audit event, the queue is full", slog.String("type", event.Type), slog.Uint64("seq", event.Sequence))
+	}
+}
+
+func (l *LoggerImpl) run() {
+	defer close(l.done)
+	for line := range l.queue {
+		for _, sink := range l.sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+			if err := sink.Write(ctx, line); err != nil {
+				metrics.AuditSinkErrors.WithLabelValues(sink.Name()).Inc()
+				slog.Error("Failed to write audit event", slog.String("sink", sink.Name()), slog.Any("error", err))
+			}
+			cancel()
+		}
+	}
+}
+
+func (l *LoggerImpl) Close(ctx context.Context) error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mu.Unlock()
+
+	var err error
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		err = errors.Join(errors.New("audit events were not written"), ctx.Err())
+	}
+	for _, sink := range l.sinks {
+		err = errors.Join(err, sink.Close())
+	}
+	return err
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Record(context.Context, Event) {}
+func (nopLogger) Close(context.Context) error   { return nil }
+
+var defaultLogger atomic.Pointer[Logger]
+
+// Init installs the default logger with the sinks of audit.sinks. The returned function writes
+// the queued events and must be called before exiting. Without audit.enabled events are discarded.
+func Init(cache *redis.Client) (func(context.Context) error, error) {
+	if !viper.GetBool("audit.enabled") {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	keySecret := config.StringOrDefault("audit.key_secret", "audit_key")
+	key := strings.TrimSpace(viper.GetString("secrets." + keySecret))
+	if key == "" {
+		return nil, fmt.Errorf("missing audit key %q", keySecret)
+	}
+
+	sinks, err := NewSinks(cache)
+	if err != nil {
+		return nil, err
+	}
+
+	queueSize := viper.GetInt("audit.queue_size")
+	if queueSize <= 0 {
+		queueSize = 10000
+	}
+	timeout := viper.GetDuration("audit.timeout")
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	logger := NewLogger(sinks, []byte(key), queueSize, timeout)
+	SetDefault(logger)
+	slog.Info("Audit log enabled", slog.Int("sinks", len(sinks)))
+	return logger.Close, nil
+}
+
+// SetDefault replaces the default logger, a nil logger discards events.
+func SetDefault(logger Logger) {
+	defaultLogger.Store(&logger)
+}
+
+func Default() Logger {
+	if logger := defaultLogger.Load(); logger != nil && *logger != nil {
+		return *logger
+	}
+	return nopLogger{}
+}
+
+// Record records event with the default logger.
+func Record(ctx context.Context, event Event) {
+	Default().Record(ctx, event)
+}
+
+// Request describes the request an event is recorded for.
+type Request struct {
+	ClientIP  string
+	UserAgent string
+	RequestID string
+}
+
+type requestKey struct{}
+
+func WithRequest(ctx context.Context, req Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, req)
+}
+
+// Middleware stores the request of events in the request context. It must follow
+// middleware.RequestID and middleware.ClientIP.
+func Middleware() middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := Request{
+				UserAgent: r.UserAgent(),
+				RequestID: middleware.RequestIDFromContext(r.Context()),
+			}
+			if addr, ok := middleware.ClientIPFromContext(r.Context()); ok {
+				req.ClientIP = addr.String()
+			}
+			next.ServeHTTP(w, r.WithContext(WithRequest(r.Context(), req)))
+		})
+	}
+}
+
+// UnaryServerInterceptor stores the request of events in the context of gRPC calls, taking
+// the client address from the peer and the request ID from the x-request-id metadata.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		var request Request
+		if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+			if addrPort, err := netip.ParseAddrPort(p.Addr.String()); err == nil {
+				request.ClientIP = addrPort.Addr().Unmap().String()
+			}
+		}
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			request.UserAgent = first(md.Get("user-agent"))
+			request.RequestID = first(md.Get("x-request-id"))
+		}
+		return handler(WithRequest(ctx, request), req)
+	}
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,230 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("audit-test-key")
+
+// record writes events to a new logger and returns the lines it wrote.
+func record(t *testing.T, events ...Event) []string {
+	var buf bytes.Buffer
+	logger := NewLogger([]Sink{NewWriterSink("buffer", &buf)}, testKey, 100, time.Second)
+	ctx := WithRequest(context.Background(), Request{ClientIP: "192.0.2.1", UserAgent: "test", RequestID: "req-1"})
+	for _, event := range events {
+		logger.Record(ctx, event)
+	}
+	require.NoError(t, logger.Close(context.Background()))
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+func TestLoggerChainsEvents(t *testing.T) {
+	lines := record(t,
+		Event{Type: TypeLogin, Tenant: "default", Subject: "alice", Session: "uid-1", Outcome: OutcomeSuccess},
+		Event{Type: TypeRefresh, Tenant: "default", Outcome: OutcomeFailure, Reason: "token_revoked"},
+	)
+	require.Len(t, lines, 2)
+
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &fields))
+	// Empty fields are present as well
+	for _, name := range []string{"time", "type", "tenant", "subject", "session", "actor", "scope", "client_ip", "user_agent", "outcome", "reason", "request_id", "chain", "seq", "prev_hash", "hash"} {
+		assert.Contains(t, fields, name)
+	}
+	assert.Equal(t, "", fields["subject"])
+	assert.Equal(t, "192.0.2.1", fields["client_ip"])
+	assert.Equal(t, "req-1", fields["request_id"])
+
+	var first, second Event
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+	assert.Equal(t, uint64(1), first.Sequence)
+	assert.Empty(t, first.PrevHash)
+	assert.Equal(t, first.Chain, second.Chain)
+	assert.Equal(t, first.Hash, second.PrevHash)
+
+	count, err := Verify(strings.NewReader(strings.Join(lines, "\n")), testKey)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	lines := record(t,
+		Event{Type: TypeLogin, Subject: "alice", Outcome: OutcomeSuccess},
+		Event{Type: TypeAuthentication, Subject: "alice", Outcome: OutcomeFailure, Reason: "token_expired"},
+		Event{Type: TypeLogout, Subject: "alice", Outcome: OutcomeSuccess},
+	)
+	other := record(t, Event{Type: TypeLogin, Subject: "bob", Outcome: OutcomeSuccess})
+
+	verify := func(lines ...string) error {
+		_, err := Verify(strings.NewReader(strings.Join(lines, "\n")), testKey)
+		return err
+	}
+
+	// Chains of several instances may be interleaved with each other and with other logs
+	assert.NoError(t, verify(lines[0], other[0], `{"level":"INFO","msg":"Request completed"}`, lines[1], lines[2]))
+	// Rotated logs may start in the middle of a chain
+	assert.NoError(t, verify(lines[1], lines[2]))
+
+	assert.ErrorIs(t, verify(lines[0], strings.Replace(lines[1], "token_expired", "token_revoked", 1), lines[2]), ErrBrokenChain)
+	assert.ErrorIs(t, verify(lines[0], lines[2]), ErrBrokenChain)
+	assert.ErrorIs(t, verify(lines[0], lines[2], lines[1]), ErrBrokenChain)
+	assert.ErrorIs(t, verify(lines[0], "garbage", lines[2]), ErrBrokenChain)
+
+	// Chains cannot be verified, or forged, without the key
+	_, err := Verify(strings.NewReader(strings.Join(lines, "\n")), []byte("other-key"))
+	assert.ErrorIs(t, err, ErrBrokenChain)
+}
+
+func TestInitRequiresKey(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("audit.enabled", true)
+	viper.Set("audit.sinks", []map[string]any{{"type": "stdout"}})
+
+	_, err := Init(nil)
+	assert.ErrorContains(t, err, "audit_key")
+
+	viper.Set("audit.key_secret", "siem_key")
+	viper.Set("secrets.siem_key", "secret\n")
+	shutdown, err := Init(nil)
+	require.NoError(t, err)
+	defer SetDefault(nil)
+	assert.NoError(t, shutdown(context.Background()))
+}
+
+// blockingSink holds the first write until it is released.
+type blockingSink struct {
+	entered chan struct{}
+	release chan struct{}
+	written chan struct{}
+	once    sync.Once
+	events  [][]byte
+}
+
+func (s *blockingSink) Name() string { return "blocking" }
+func (s *blockingSink) Close() error { return nil }
+func (s *blockingSink) Write(_ context.Context, event []byte) error {
+	s.once.Do(func() {
+		close(s.entered)
+		<-s.release
+	})
+	s.events = append(s.events, append([]byte(nil), event...))
+	s.written <- struct{}{}
+	return nil
+}
+
+func TestDroppedEventsBreakChain(t *testing.T) {
+	sink := &blockingSink{entered: make(chan struct{}), release: make(chan struct{}), written: make(chan struct{}, 10)}
+	logger := NewLogger([]Sink{sink}, testKey, 1, time.Second)
+
+	dropped := testutil.ToFloat64(metrics.AuditEvents.WithLabelValues(metrics.AuditDropped))
+	logger.Record(context.Background(), Event{Type: TypeLogin})
+	<-sink.entered
+	logger.Record(context.Background(), Event{Type: TypeLogin}) // queued
+	logger.Record(context.Background(), Event{Type: TypeLogin}) // dropped
+	close(sink.release)
+	<-sink.written
+	<-sink.written
+	logger.Record(context.Background(), Event{Type: TypeLogin})
+	require.NoError(t, logger.Close(context.Background()))
+
+	assert.Equal(t, dropped+1, testutil.ToFloat64(metrics.AuditEvents.WithLabelValues(metrics.AuditDropped)))
+	require.Len(t, sink.events, 3)
+	_, err := Verify(bytes.NewReader(bytes.Join(sink.events, []byte("\n"))), testKey)
+	assert.ErrorIs(t, err, ErrBrokenChain)
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	sink, err := NewFileSink(path, 100, 2)
+	require.NoError(t, err)
+
+	line := []byte(`{"event":"` + strings.Repeat("x", 30) + `"}`) // 43 bytes with the newline
+	for range 7 {
+		require.NoError(t, sink.Write(context.Background(), line))
+	}
+	require.NoError(t, sink.Close())
+
+	// Two lines fit a file, the oldest file was removed
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(data), 100)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Reopening appends to the current file
+	sink, err = NewFileSink(path, 100, 2)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), line))
+	require.NoError(t, sink.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(data, []byte("\n")))
+}
+
+func TestFileSinkKeepsWritingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// A non-empty directory cannot be replaced by the current file
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o700))
+	sink, err := NewFileSink(path, 100, 1)
+	require.NoError(t, err)
+
+	line := []byte(`{"event":"` + strings.Repeat("x", 30) + `"}`)
+	for range 3 {
+		require.NoError(t, sink.Write(context.Background(), line))
+	}
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, bytes.Count(data, []byte("\n")))
+
+	// Rotation resumes once the backup can be written
+	require.NoError(t, os.RemoveAll(path+".1"))
+	require.NoError(t, sink.Write(context.Background(), line))
+	require.NoError(t, sink.Close())
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(data, []byte("\n")))
+	data, err = os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, bytes.Count(data, []byte("\n")))
+}
+
+func TestWebhookSink(t *testing.T) {
+	var received []byte
+	status := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, "secret")
+	defer sink.Close()
+	require.NoError(t, sink.Write(context.Background(), []byte(`{"type":"login"}`)))
+	assert.JSONEq(t, `{"type":"login"}`, string(received))
+
+	status = http.StatusInternalServerError
+	assert.Error(t, sink.Write(context.Background(), []byte(`{"type":"login"}`)))
+}
@@ -0,0 +1,275 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+var ErrUnsupportedSink = errors.New("unsupported audit sink")
+
+// Sink receives serialized events. Sinks are only called from the goroutine of their logger.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, event []byte) error
+	Close() error
+}
+
+type SinkConfig struct {
+	Type string `mapstructure:"type"`
+	// file
+	Path       string `mapstructure:"path"`
+	MaxSizeMB  int64  `mapstructure:"max_size_mb"`
+	MaxBackups int    `mapstructure:"max_backups"`
+	// redis
+	Stream string `mapstructure:"stream"`
+	MaxLen int64  `mapstructure:"max_len"`
+	// webhook
+	URL         string `mapstructure:"url"`
+	TokenSecret string `mapstructure:"token_secret"`
+}
+
+// NewSinks creates the sinks of audit.sinks.
+func NewSinks(cache *redis.Client) ([]Sink, error) {
+	var configs []SinkConfig
+	if err := viper.UnmarshalKey("audit.sinks", &configs); err != nil {
+		return nil, err
+	}
+
+	sinks := make([]Sink, 0, len(configs))
+	for _, config := range configs {
+		sink, err := newSink(config, cache)
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func newSink(config SinkConfig, cache *redis.Client) (Sink, error) {
+	switch config.Type {
+	case "stdout":
+		return NewWriterSink("stdout", os.Stdout), nil
+	case "file":
+		return NewFileSink(config.Path, config.MaxSizeMB<<20, config.MaxBackups)
+	case "redis":
+		stream := config.Stream
+		if stream == "" {
+			stream = "audit"
+		}
+		return NewRedisStreamSink(cache, stream, config.MaxLen), nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, fmt.Errorf("%w: webhook without url", ErrUnsupportedSink)
+		}
+		token := ""
+		if config.TokenSecret != "" {
+			token = strings.TrimSpace(viper.GetString("secrets." + config.TokenSecret))
+		}
+		return NewWebhookSink(config.URL, token), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSink, config.Type)
+	}
+}
+
+// WriterSink writes events as JSON lines.
+type WriterSink struct {
+	name string
+	w    io.Writer
+}
+
+func NewWriterSink(name string, w io.Writer) Sink {
+	return &WriterSink{name: name, w: w}
+}
+
+func (s *WriterSink) Name() string {
+	return s.name
+}
+
+func (s *WriterSink) Write(_ context.Context, event []byte) error {
+	_, err := s.w.Write(append(event, '\n'))
+	return err
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink appends events as JSON lines to a file. Once the file would exceed maxSize bytes
+// it is renamed to path.1, shifting older files up to path.<maxBackups>, and a new file is started.
+// A non-positive maxSize disables rotation. Missing parent directories are created.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewFileSink(path string, maxSize int64, maxBackups int) (Sink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: file without path", ErrUnsupportedSink)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(_ context.Context, event []byte) error {
+	line := append(event, '\n')
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			// Events keep going to the current file, and the next write tries again
+			slog.Error("Failed to rotate audit file", slog.String("path", s.path), slog.Any("error", err))
+		}
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate starts a new file. When the current file cannot be moved away, it is reopened instead.
+// The file is left nil only if the path cannot be opened at all.
+func (s *FileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err == nil {
+		err = s.shift()
+	}
+	return errors.Join(err, s.open())
+}
+
+// shift moves the current file to path.1 and older files up by one, or removes it without backups.
+func (s *FileSink) shift() error {
+	if s.maxBackups <= 0 {
+		return os.Remove(s.path)
+	}
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// RedisStreamSink adds events to a Redis stream in the event field, trimming the stream to
+// about maxLen entries. A non-positive maxLen keeps every event.
+type RedisStreamSink struct {
+	cache  *redis.Client
+	stream string
+	maxLen int64
+}
+
+func NewRedisStreamSink(cache *redis.Client, stream string, maxLen int64) Sink {
+	return &RedisStreamSink{cache: cache, stream: stream, maxLen: maxLen}
+}
+
+func (s *RedisStreamSink) Name() string {
+	return "redis"
+}
+
+func (s *RedisStreamSink) Write(ctx context.Context, event []byte) error {
+	args := &redis.XAddArgs{Stream: s.stream, Values: map[string]any{"event": event}}
+	if s.maxLen > 0 {
+		args.MaxLen, args.Approx = s.maxLen, true
+	}
+	return s.cache.XAdd(ctx, args).Err()
+}
+
+func (s *RedisStreamSink) Close() error {
+	return nil
+}
+
+// WebhookSink posts every event as a JSON document to a URL, with a bearer token if set.
+// Responses other than 2xx are failures.
+type WebhookSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func NewWebhookSink(url, token string) Sink {
+	return &WebhookSink{url: url, token: token, client: &http.Client{}}
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Write(ctx context.Context, event []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(event))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
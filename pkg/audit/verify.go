@@ -0,0 +1,59 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrBrokenChain = errors.New("audit chain is broken")
+
+// Verify checks the hash chains of the events read from r, one per line, with the key of their
+// loggers and returns their number. Events of several instances may be interleaved, each chain
+// is checked on its own. Missing, modified or reordered events fail the check. Events removed
+// from the end of a chain, or whole chains, cannot be detected from the log alone.
+func Verify(r io.Reader, key []byte) (int, error) {
+	type link struct {
+		sequence uint64
+		hash     string
+	}
+	last := map[string]link{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	count := 0
+	for line := 1; scanner.Scan(); line++ {
+		// Other lines, such as application logs next to the stdout sink, are skipped. Events
+		// turned into such lines still break the chain.
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Chain == "" {
+			continue
+		}
+
+		hash, err := event.ComputeHash(key)
+		if err != nil {
+			return count, err
+		}
+		if hash != event.Hash {
+			return count, errors.Join(ErrBrokenChain, fmt.Errorf("line %d: event was modified", line))
+		}
+
+		// A chain may start at any point of a rotated log
+		if previous, ok := last[event.Chain]; ok {
+			if event.Sequence != previous.sequence+1 {
+				return count, errors.Join(ErrBrokenChain, fmt.Errorf("line %d: expected event %d of chain %s, found %d", line, previous.sequence+1, event.Chain, event.Sequence))
+			}
+			if event.PrevHash != previous.hash {
+				return count, errors.Join(ErrBrokenChain, fmt.Errorf("line %d: event does not follow the previous event of chain %s", line, event.Chain))
+			}
+		} else if event.Sequence == 1 && event.PrevHash != "" {
+			return count, errors.Join(ErrBrokenChain, fmt.Errorf("line %d: first event of chain %s has a predecessor", line, event.Chain))
+		}
+
+		last[event.Chain] = link{sequence: event.Sequence, hash: event.Hash}
+		count++
+	}
+	return count, scanner.Err()
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/audit"
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// recordEvent adds the outcome of an operation to the audit log. Failures carry their reason code.
+func recordEvent(ctx context.Context, eventType string, t *tenant.Tenant, subject, session string, err error) {
+	record(ctx, t, audit.Event{Type: eventType, Subject: subject, Session: session}, err)
+}
+
+// record completes event with the tenant and the outcome of err and adds it to the audit log.
+func record(ctx context.Context, t *tenant.Tenant, event audit.Event, err error) {
+	event.Tenant = t.ID
+	event.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+		event.Reason = string(ReasonOf(err))
+	}
+	audit.Record(ctx, event)
+}
+
+// recordTokenEvent records an operation on the token of claims, which are nil when the token
+// could not be parsed.
+func recordTokenEvent(ctx context.Context, eventType string, t *tenant.Tenant, claims *authjwt.JWTClaims, err error) {
+	var subject, session string
+	if claims != nil {
+		subject, session = claims.Subject, claims.UID
+	}
+	recordEvent(ctx, eventType, t, subject, session, err)
+}
+
+// issuedUID reads the UID of a token this service has just issued, without verifying it again.
+func issuedUID(token string) string {
+	claims := &authjwt.JWTClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return ""
+	}
+	return claims.UID
+}
@@ -2,22 +2,60 @@ package auth_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/GregoryKogan/jwt-microservice/pkg/audit"
 	"github.com/GregoryKogan/jwt-microservice/pkg/auth"
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/dpop"
+	"github.com/GregoryKogan/jwt-microservice/pkg/breaker"
 	"github.com/GregoryKogan/jwt-microservice/pkg/cache"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/GregoryKogan/jwt-microservice/pkg/mtls"
+	authv1 "github.com/GregoryKogan/jwt-microservice/pkg/pb/auth/v1"
+	"github.com/GregoryKogan/jwt-microservice/pkg/ratelimit"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type AuthTestSuite struct {
 	suite.Suite
 	mockCache cache.MockCache
+	tenants   tenant.Registry
+	repo      auth.AuthRepo
 	service   auth.AuthService
 	handler   auth.AuthHandler
 }
@@ -28,7 +66,12 @@ func (s *AuthTestSuite) SetupSuite() {
 	viper.Set("auth.access_lifetime", 15*time.Minute)
 	viper.Set("auth.refresh_lifetime", 720*time.Hour)
 	viper.Set("auth.auto_logout", 24*time.Hour)
+	viper.Set("auth.legacy_user_id_claim", true)
 	viper.Set("logging.level", "debug")
+	viper.Set("tenancy.resolver", "header")
+	viper.Set("tenancy.default_fallback", true)
+	viper.Set("tenancy.tenants.acme.issuer", "acme-auth")
+	viper.Set("secrets.jwt_key_acme", "acme_secret_key")
 
 	s.mockCache = cache.NewMockCache()
 }
@@ -38,12 +81,17 @@ func (s *AuthTestSuite) TearDownSuite() {
 }
 
 func (s *AuthTestSuite) SetupTest() {
-	repo := auth.NewAuthRepo(s.mockCache.Cache())
-	s.service = auth.NewAuthService(repo)
-	s.handler = auth.NewAuthHandler(s.service)
+	tenants, err := tenant.NewRegistry()
+	s.Require().NoError(err)
+
+	s.tenants = tenants
+	s.repo = auth.NewAuthRepo(s.mockCache.Cache())
+	s.service = auth.NewAuthService(s.repo)
+	s.handler = auth.NewAuthHandler(s.service, s.tenants, dpop.NewVerifier(s.repo))
 }
 
 func (s *AuthTestSuite) TearDownTest() {
+	s.repo.Close(context.Background())
 	s.mockCache.Flush()
 }
 
@@ -78,12 +126,37 @@ func (s *AuthTestSuite) TestLoginFlow() {
 
 	var claims map[string]interface{}
 	json.Unmarshal(w.Body.Bytes(), &claims)
+	s.Equal("1", claims["sub"])
 	s.Equal(float64(1), claims["user_id"])
 }
 
+func (s *AuthTestSuite) TestOpaqueSubject() {
+	subject := "3f1c2a9e-5b7d-4e8a-9c6f-1a2b3c4d5e6f"
+	body, _ := json.Marshal(map[string]string{"sub": subject})
+	req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	s.handler.Login(w, req)
+	s.Equal(http.StatusOK, w.Code)
+
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	claims, err := s.service.Authenticate(context.Background(), s.tenants.Default(), resp["access"], nil, nil)
+	s.Require().NoError(err)
+	s.Equal(subject, claims.Subject)
+	s.Empty(claims.UserID)
+
+	// Login without any subject is rejected
+	req = httptest.NewRequest(http.MethodPost, "/login", bytes.NewBufferString("{}"))
+	w = httptest.NewRecorder()
+	s.handler.Login(w, req)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
 func (s *AuthTestSuite) TestRefreshFlow() {
 	// First login to get tokens
-	loginResp, _ := s.service.Login(1)
+	loginResp, _ := s.service.Login(context.Background(), s.tenants.Default(), &authjwt.Grant{Subject: "1"})
 
 	// Test refresh
 	refreshReq := map[string]string{
@@ -105,7 +178,7 @@ func (s *AuthTestSuite) TestRefreshFlow() {
 
 func (s *AuthTestSuite) TestLogoutFlow() {
 	// First login to get tokens
-	loginResp, _ := s.service.Login(1)
+	loginResp, _ := s.service.Login(context.Background(), s.tenants.Default(), &authjwt.Grant{Subject: "1"})
 
 	// Test logout
 	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
@@ -121,7 +194,8 @@ func (s *AuthTestSuite) TestLogoutFlow() {
 	w = httptest.NewRecorder()
 
 	s.handler.Authenticate(w, authReq)
-	s.Equal(http.StatusBadRequest, w.Code)
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal("token_revoked", problemCode(w))
 }
 
 func (s *AuthTestSuite) TestInvalidMethods() {
@@ -156,7 +230,8 @@ func (s *AuthTestSuite) TestInvalidTokens() {
 	w := httptest.NewRecorder()
 
 	s.handler.Authenticate(w, req)
-	s.Equal(http.StatusBadRequest, w.Code)
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal("token_malformed", problemCode(w))
 
 	// Test with invalid refresh token
 	refreshReq := map[string]string{
@@ -167,5 +242,1228 @@ func (s *AuthTestSuite) TestInvalidTokens() {
 	w = httptest.NewRecorder()
 
 	s.handler.Refresh(w, req)
-	s.Equal(http.StatusInternalServerError, w.Code)
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal("token_malformed", problemCode(w))
+}
+
+func (s *AuthTestSuite) TestErrorReasons() {
+	def := s.tenants.Default()
+	acme, err := s.tenants.Get("acme")
+	s.Require().NoError(err)
+	jwtService := authjwt.NewJWTService()
+	grant := &authjwt.Grant{Subject: "1"}
+
+	foreignKey, err := jwtService.NewAccessToken(context.Background(), acme, grant)
+	s.Require().NoError(err)
+	foreignIssuer, err := jwtService.NewAccessToken(context.Background(), &tenant.Tenant{Key: def.Key, Issuer: "other", AccessLifetime: time.Minute}, grant)
+	s.Require().NoError(err)
+	expired, err := jwtService.NewAccessToken(context.Background(), &tenant.Tenant{Key: def.Key, Issuer: def.Issuer, AccessLifetime: -time.Minute}, grant)
+	s.Require().NoError(err)
+	notCached, err := jwtService.NewAccessToken(context.Background(), def, grant)
+	s.Require().NoError(err)
+
+	tests := []struct {
+		name   string
+		token  string
+		reason auth.Reason
+	}{
+		{"Malformed", "not.a.jwt", auth.ReasonTokenMalformed},
+		{"Wrong key", foreignKey, auth.ReasonSignatureInvalid},
+		{"Wrong issuer", foreignIssuer, auth.ReasonIssuerInvalid},
+		{"Expired", expired, auth.ReasonTokenExpired},
+		{"Revoked", notCached, auth.ReasonTokenRevoked},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			_, err := s.service.Authenticate(context.Background(), def, tt.token, nil, nil)
+			assert.ErrorIs(t, err, authjwt.ErrInvalidToken, "all token errors remain invalid token errors")
+			assert.Equal(t, tt.reason, auth.ReasonOf(err))
+		})
+	}
+}
+
+func (s *AuthTestSuite) TestTokenErrorCodes() {
+	tokens, err := s.service.Login(context.Background(), s.tenants.Default(), &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	// Refresh token used as an access token
+	req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Refresh)
+	w := httptest.NewRecorder()
+	s.handler.Authenticate(w, req)
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal("invalid_token_type", problemCode(w))
+	s.Equal("application/problem+json", w.Header().Get("Content-Type"))
+
+	// Expired access token
+	viper.Set("auth.access_lifetime", -time.Minute)
+	tenants, err := tenant.NewRegistry()
+	viper.Set("auth.access_lifetime", 15*time.Minute)
+	s.Require().NoError(err)
+
+	expiredAccess, err := authjwt.NewJWTService().NewAccessToken(context.Background(), tenants.Default(), &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	req = httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.Header.Set("Authorization", "Bearer "+expiredAccess)
+	w = httptest.NewRecorder()
+	s.handler.Authenticate(w, req)
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal("token_expired", problemCode(w))
+
+	// Missing credentials
+	req = httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	w = httptest.NewRecorder()
+	s.handler.Authenticate(w, req)
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal("missing_token", problemCode(w))
+}
+
+func problemCode(w *httptest.ResponseRecorder) string {
+	var body struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return body.Code
+}
+
+func (s *AuthTestSuite) TestTenantIsolation() {
+	acme, err := s.tenants.Get("acme")
+	s.Require().NoError(err)
+
+	acmeTokens, err := s.service.Login(context.Background(), acme, &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+	defaultTokens, err := s.service.Login(context.Background(), s.tenants.Default(), &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	// Token is accepted only by the tenant that issued it
+	req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.Header.Set("Authorization", "Bearer "+acmeTokens.Access)
+	req.Header.Set("X-Tenant-ID", "acme")
+	w := httptest.NewRecorder()
+	s.handler.Authenticate(w, req)
+	s.Equal(http.StatusOK, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.Header.Set("Authorization", "Bearer "+acmeTokens.Access)
+	w = httptest.NewRecorder()
+	s.handler.Authenticate(w, req)
+	s.Equal(http.StatusUnauthorized, w.Code)
+
+	// Sessions of the same user in different tenants do not affect each other
+	s.NoError(s.service.Logout(context.Background(), acme, acmeTokens.Access, nil))
+	_, err = s.service.Authenticate(context.Background(), s.tenants.Default(), defaultTokens.Access, nil, nil)
+	s.NoError(err)
+
+	// Unknown tenants are rejected
+	req = httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.Header.Set("Authorization", "Bearer "+defaultTokens.Access)
+	req.Header.Set("X-Tenant-ID", "unknown")
+	w = httptest.NewRecorder()
+	s.handler.Authenticate(w, req)
+	s.Equal(http.StatusNotFound, w.Code)
+}
+
+func (s *AuthTestSuite) TestCookieFlow() {
+	viper.Set("auth.cookies.enabled", true)
+	defer viper.Set("auth.cookies.enabled", false)
+	handler := auth.NewAuthHandler(s.service, s.tenants, dpop.NewVerifier(s.repo))
+
+	// Login delivers tokens in cookies only
+	body, _ := json.Marshal(map[string]string{"sub": "1"})
+	req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler.Login(w, req)
+	s.Equal(http.StatusNoContent, w.Code)
+	s.Empty(w.Body.Bytes())
+
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	s.Require().Contains(cookies, "access_token")
+	s.Require().Contains(cookies, "refresh_token")
+	s.Require().Contains(cookies, "csrf_token")
+	s.True(cookies["access_token"].HttpOnly)
+	s.True(cookies["access_token"].Secure)
+	s.Equal(http.SameSiteStrictMode, cookies["access_token"].SameSite)
+	s.False(cookies["csrf_token"].HttpOnly)
+
+	withCookies := func(r *http.Request) *http.Request {
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+
+	// Safe methods do not need the CSRF token
+	w = httptest.NewRecorder()
+	handler.Authenticate(w, withCookies(httptest.NewRequest(http.MethodGet, "/authenticate", nil)))
+	s.Equal(http.StatusOK, w.Code)
+
+	// Unsafe methods are rejected without a matching CSRF header
+	w = httptest.NewRecorder()
+	handler.Refresh(w, withCookies(httptest.NewRequest(http.MethodPost, "/refresh", nil)))
+	s.Equal(http.StatusForbidden, w.Code)
+
+	req = withCookies(httptest.NewRequest(http.MethodPost, "/refresh", nil))
+	req.Header.Set("X-CSRF-Token", "forged")
+	w = httptest.NewRecorder()
+	handler.Refresh(w, req)
+	s.Equal(http.StatusForbidden, w.Code)
+
+	req = withCookies(httptest.NewRequest(http.MethodPost, "/refresh", nil))
+	req.Header.Set("X-CSRF-Token", cookies["csrf_token"].Value)
+	w = httptest.NewRecorder()
+	handler.Refresh(w, req)
+	s.Equal(http.StatusNoContent, w.Code)
+
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+
+	// Logout clears the cookies
+	req = withCookies(httptest.NewRequest(http.MethodPost, "/logout", nil))
+	req.Header.Set("X-CSRF-Token", cookies["csrf_token"].Value)
+	w = httptest.NewRecorder()
+	handler.Logout(w, req)
+	s.Equal(http.StatusOK, w.Code)
+	for _, cookie := range w.Result().Cookies() {
+		s.Equal(-1, cookie.MaxAge)
+	}
+}
+
+func (s *AuthTestSuite) TestForwardAuth() {
+	tokens, err := s.service.Login(context.Background(), s.tenants.Default(), &authjwt.Grant{Subject: "1", Scope: "read write"})
+	s.Require().NoError(err)
+
+	// Proxies may forward any method of the original request
+	req := httptest.NewRequest(http.MethodPost, "/forward-auth", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Access)
+	w := httptest.NewRecorder()
+	s.handler.ForwardAuth(w, req)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("1", w.Header().Get("X-User-Id"))
+	s.Equal("read write", w.Header().Get("X-Scopes"))
+
+	// Scopes survive token refresh
+	refreshed, err := s.service.Refresh(context.Background(), s.tenants.Default(), tokens.Refresh, nil)
+	s.Require().NoError(err)
+	claims, err := s.service.Authenticate(context.Background(), s.tenants.Default(), refreshed.Access, nil, nil)
+	s.Require().NoError(err)
+	s.Equal("read write", claims.Scope)
+
+	req = httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Access)
+	w = httptest.NewRecorder()
+	s.handler.ForwardAuth(w, req)
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Empty(w.Header().Get("X-User-Id"))
+
+	req = httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+	w = httptest.NewRecorder()
+	s.handler.ForwardAuth(w, req)
+	s.Equal(http.StatusUnauthorized, w.Code)
+}
+
+func (s *AuthTestSuite) TestGRPCFlow() {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	authv1.RegisterAuthServiceServer(server, auth.NewAuthGRPCServer(s.service, s.tenants))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	s.Require().NoError(err)
+	defer conn.Close()
+
+	client := authv1.NewAuthServiceClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "acme")
+
+	login, err := client.Login(ctx, &authv1.LoginRequest{Sub: "1", Scope: "read"})
+	s.Require().NoError(err)
+
+	resp, err := client.Authenticate(ctx, &authv1.AuthenticateRequest{Access: login.Access})
+	s.Require().NoError(err)
+	s.Equal("1", resp.Claims.Sub)
+	s.Equal("read", resp.Claims.Scope)
+	s.Equal("acme-auth", resp.Claims.Iss)
+	s.Nil(resp.Claims.Cnf)
+	s.Nil(resp.Claims.Act)
+
+	// Delegated tokens name their actor chain
+	acme, err := s.tenants.Get("acme")
+	s.Require().NoError(err)
+	delegated, err := s.service.Login(context.Background(), acme, &authjwt.Grant{
+		Subject: "2",
+		Actor:   &authjwt.Actor{Subject: "svc-orders", Actor: &authjwt.Actor{Subject: "gateway"}},
+	})
+	s.Require().NoError(err)
+	resp, err = client.Authenticate(ctx, &authv1.AuthenticateRequest{Access: delegated.Access})
+	s.Require().NoError(err)
+	s.Equal("svc-orders", resp.Claims.Act.GetSub())
+	s.Equal("gateway", resp.Claims.Act.GetAct().GetSub())
+
+	// Step-up requirements are checked against the authentication recorded at login
+	authTime := time.Now().Add(-10 * time.Minute)
+	strong, err := client.Login(ctx, &authv1.LoginRequest{Sub: "3", Acr: "mfa", Amr: []string{"pwd", "otp"}, AuthTime: timestamppb.New(authTime)})
+	s.Require().NoError(err)
+	resp, err = client.Authenticate(ctx, &authv1.AuthenticateRequest{Access: strong.Access, AcrValues: []string{"mfa"}, MaxAge: proto.Uint32(900)})
+	s.Require().NoError(err)
+	s.Equal("mfa", resp.Claims.Acr)
+	s.Equal([]string{"pwd", "otp"}, resp.Claims.Amr)
+	s.Equal(authTime.Unix(), resp.Claims.AuthTime.GetSeconds())
+
+	_, err = client.Authenticate(ctx, &authv1.AuthenticateRequest{Access: strong.Access, AcrValues: []string{"hwk"}, MaxAge: proto.Uint32(300)})
+	s.Equal(codes.Unauthenticated, status.Code(err))
+	details := status.Convert(err).Details()
+	s.Require().Len(details, 1)
+	info := details[0].(*errdetails.ErrorInfo)
+	s.Equal(string(auth.ReasonStepUpRequired), info.Reason)
+	s.Equal(map[string]string{"acr_values": "hwk", "max_age": "300"}, info.Metadata)
+
+	_, err = client.Login(ctx, &authv1.LoginRequest{Sub: "3", AuthTime: timestamppb.New(time.Now().Add(time.Hour))})
+	s.Equal(codes.InvalidArgument, status.Code(err))
+
+	// The token belongs to the acme tenant only
+	_, err = client.Authenticate(context.Background(), &authv1.AuthenticateRequest{Access: login.Access})
+	s.Equal(codes.Unauthenticated, status.Code(err))
+	details = status.Convert(err).Details()
+	s.Require().Len(details, 1)
+	s.Equal(string(auth.ReasonSignatureInvalid), details[0].(*errdetails.ErrorInfo).Reason)
+
+	refreshed, err := client.Refresh(ctx, &authv1.RefreshRequest{Refresh: login.Refresh})
+	s.Require().NoError(err)
+
+	_, err = client.Logout(ctx, &authv1.LogoutRequest{Access: refreshed.Access})
+	s.Require().NoError(err)
+
+	_, err = client.Authenticate(ctx, &authv1.AuthenticateRequest{Access: refreshed.Access})
+	s.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func (s *AuthTestSuite) TestAuthorizationHeaderParsing() {
+	tokens, err := s.service.Login(context.Background(), s.tenants.Default(), &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	tests := []struct {
+		name      string
+		header    string
+		wantCode  int
+		challenge string
+	}{
+		{"Lowercase scheme", "bearer " + tokens.Access, http.StatusOK, ""},
+		{"Uppercase scheme", "BEARER " + tokens.Access, http.StatusOK, ""},
+		{"Scheme only", "Bearer", http.StatusBadRequest, `Bearer realm="jwt-microservice", error="invalid_request"`},
+		{"Short header", "Bea", http.StatusUnauthorized, `Bearer realm="jwt-microservice"`},
+		{"Unsupported scheme", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, `Bearer realm="jwt-microservice"`},
+		{"Extra credentials", "Bearer " + tokens.Access + " extra", http.StatusBadRequest, `error="invalid_request"`},
+		{"Invalid token", "Bearer invalid", http.StatusUnauthorized, `error="invalid_token", error_description="token is malformed"`},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+			req.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+
+			s.handler.Authenticate(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Contains(t, w.Header().Get("WWW-Authenticate"), tt.challenge)
+		})
+	}
+
+	// Missing credentials get a challenge without an error code
+	req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	w := httptest.NewRecorder()
+	s.handler.Authenticate(w, req)
+	s.Equal(`Bearer realm="jwt-microservice"`, w.Header().Get("WWW-Authenticate"))
+}
+
+func (s *AuthTestSuite) TestFormPostCredentials() {
+	tokens, err := s.service.Login(context.Background(), s.tenants.Default(), &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	// Credentials may not be presented twice
+	req := httptest.NewRequest(http.MethodPost, "/logout", bytes.NewBufferString("access_token="+tokens.Access))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+tokens.Access)
+	w := httptest.NewRecorder()
+	s.handler.Logout(w, req)
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/logout", bytes.NewBufferString("access_token="+tokens.Access))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	s.handler.Logout(w, req)
+	s.Equal(http.StatusOK, w.Code)
+
+	_, err = s.service.Authenticate(context.Background(), s.tenants.Default(), tokens.Access, nil, nil)
+	s.ErrorIs(err, auth.ErrTokenRevoked)
+}
+
+func (s *AuthTestSuite) TestCertificateBoundTokens() {
+	viper.Set("auth.certificate_binding", true)
+	defer viper.Set("auth.certificate_binding", false)
+	handler := auth.NewAuthHandler(s.service, s.tenants, dpop.NewVerifier(s.repo))
+
+	withCert := func(req *http.Request, thumbprint string) *http.Request {
+		return req.WithContext(mtls.WithIdentity(req.Context(), &mtls.Identity{Thumbprint: thumbprint}))
+	}
+
+	// Tokens issued over mTLS are bound to the client certificate
+	body, _ := json.Marshal(map[string]string{"sub": "1"})
+	req := withCert(httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)), "client-a")
+	w := httptest.NewRecorder()
+	handler.Login(w, req)
+	s.Require().Equal(http.StatusOK, w.Code)
+
+	var tokens auth.TokenPair
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	authenticate := func(thumbprint string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.Access)
+		if thumbprint != "" {
+			req = withCert(req, thumbprint)
+		}
+		w := httptest.NewRecorder()
+		handler.Authenticate(w, req)
+		return w
+	}
+
+	w = authenticate("client-a")
+	s.Equal(http.StatusOK, w.Code)
+	var claims map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &claims)
+	s.Equal(map[string]interface{}{"x5t#S256": "client-a"}, claims["cnf"])
+
+	// A stolen token is useless without the certificate
+	for _, thumbprint := range []string{"", "client-b"} {
+		w = authenticate(thumbprint)
+		s.Equal(http.StatusUnauthorized, w.Code)
+		s.Equal(string(auth.ReasonTokenBindingMismatch), problemCode(w))
+	}
+
+	// Refreshed tokens stay bound
+	_, err := s.service.Refresh(context.Background(), s.tenants.Default(), tokens.Refresh, &auth.Sender{CertificateThumbprint: "client-b"})
+	s.ErrorIs(err, auth.ErrTokenBindingMismatch)
+	refreshed, err := s.service.Refresh(context.Background(), s.tenants.Default(), tokens.Refresh, &auth.Sender{CertificateThumbprint: "client-a"})
+	s.Require().NoError(err)
+	refreshedClaims, err := s.service.Authenticate(context.Background(), s.tenants.Default(), refreshed.Access, &auth.Sender{CertificateThumbprint: "client-a"}, nil)
+	s.Require().NoError(err)
+	s.Equal("client-a", refreshedClaims.Confirmation.X5TS256)
+
+	// A stolen token cannot end the session either
+	logout := func(thumbprint string) *httptest.ResponseRecorder {
+		req := withCert(httptest.NewRequest(http.MethodPost, "/logout", nil), thumbprint)
+		req.Header.Set("Authorization", "Bearer "+refreshed.Access)
+		w := httptest.NewRecorder()
+		handler.Logout(w, req)
+		return w
+	}
+	w = logout("client-b")
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal(string(auth.ReasonTokenBindingMismatch), problemCode(w))
+	_, err = s.service.Authenticate(context.Background(), s.tenants.Default(), refreshed.Access, &auth.Sender{CertificateThumbprint: "client-a"}, nil)
+	s.NoError(err)
+	s.Equal(http.StatusOK, logout("client-a").Code)
+	_, err = s.service.Authenticate(context.Background(), s.tenants.Default(), refreshed.Access, &auth.Sender{CertificateThumbprint: "client-a"}, nil)
+	s.ErrorIs(err, auth.ErrTokenRevoked)
+
+	// Tokens issued without a certificate remain bearer tokens
+	body, _ = json.Marshal(map[string]string{"sub": "2"})
+	w = httptest.NewRecorder()
+	handler.Login(w, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+	s.Require().Equal(http.StatusOK, w.Code)
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &tokens))
+	s.Equal(http.StatusOK, authenticate("client-b").Code)
+}
+
+func newDPoPProof(s *AuthTestSuite, key *ecdsa.PrivateKey, method, uri, accessToken, nonce string) string {
+	claims := jwt.MapClaims{"jti": uuid.New().String(), "htm": method, "htu": uri, "iat": time.Now().Unix()}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = "dpop+jwt"
+	token.Header["jwk"] = map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+	signed, err := token.SignedString(key)
+	s.Require().NoError(err)
+	return signed
+}
+
+func (s *AuthTestSuite) TestDPoPFlow() {
+	viper.Set("auth.dpop.enabled", true)
+	defer viper.Set("auth.dpop.enabled", false)
+	handler := auth.NewAuthHandler(s.service, s.tenants, dpop.NewVerifier(s.repo))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+
+	login := func(proof string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"sub": "1"})
+		req := httptest.NewRequest(http.MethodPost, "http://auth.example.com/login", bytes.NewBuffer(body))
+		req.Header.Set("DPoP", proof)
+		w := httptest.NewRecorder()
+		handler.Login(w, req)
+		return w
+	}
+
+	// The first proof lacks a nonce and is answered with one
+	w := login(newDPoPProof(s, key, http.MethodPost, "http://auth.example.com/login", "", ""))
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal(string(auth.ReasonUseDPoPNonce), problemCode(w))
+	s.Contains(w.Header().Get("WWW-Authenticate"), `DPoP realm="jwt-microservice", error="use_dpop_nonce"`)
+	nonce := w.Header().Get("DPoP-Nonce")
+	s.Require().NotEmpty(nonce)
+
+	w = login(newDPoPProof(s, key, http.MethodPost, "http://auth.example.com/login", "", nonce))
+	s.Require().Equal(http.StatusOK, w.Code)
+	nonce = w.Header().Get("DPoP-Nonce")
+	var tokens auth.TokenPair
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	authenticate := func(scheme, proof string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://auth.example.com/authenticate", nil)
+		req.Header.Set("Authorization", scheme+" "+tokens.Access)
+		if proof != "" {
+			req.Header.Set("DPoP", proof)
+		}
+		w := httptest.NewRecorder()
+		handler.Authenticate(w, req)
+		return w
+	}
+
+	proof := newDPoPProof(s, key, http.MethodGet, "http://auth.example.com/authenticate", tokens.Access, nonce)
+	w = authenticate("DPoP", proof)
+	s.Require().Equal(http.StatusOK, w.Code)
+	var claims map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &claims)
+	s.Contains(claims["cnf"], "jkt")
+
+	// Proofs cannot be replayed
+	w = authenticate("DPoP", proof)
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal(string(auth.ReasonInvalidDPoPProof), problemCode(w))
+
+	// Bound tokens cannot be used as bearer tokens or without a proof
+	w = authenticate("Bearer", "")
+	s.Equal(string(auth.ReasonTokenBindingMismatch), problemCode(w))
+	w = authenticate("DPoP", "")
+	s.Equal(string(auth.ReasonInvalidDPoPProof), problemCode(w))
+	s.Contains(w.Header().Get("WWW-Authenticate"), "algs=")
+
+	// A proof signed by another key does not match the binding
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	w = authenticate("DPoP", newDPoPProof(s, otherKey, http.MethodGet, "http://auth.example.com/authenticate", tokens.Access, nonce))
+	s.Equal(string(auth.ReasonTokenBindingMismatch), problemCode(w))
+
+	// Proofs are bound to the request they were made for
+	w = authenticate("DPoP", newDPoPProof(s, key, http.MethodGet, "http://auth.example.com/login", tokens.Access, nonce))
+	s.Equal(string(auth.ReasonInvalidDPoPProof), problemCode(w))
+
+	// Refreshing requires a proof of the same key
+	refresh := func(key *ecdsa.PrivateKey) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"refresh": tokens.Refresh})
+		req := httptest.NewRequest(http.MethodPost, "http://auth.example.com/refresh", bytes.NewBuffer(body))
+		req.Header.Set("DPoP", newDPoPProof(s, key, http.MethodPost, "http://auth.example.com/refresh", "", nonce))
+		w := httptest.NewRecorder()
+		handler.Refresh(w, req)
+		return w
+	}
+	w = refresh(otherKey)
+	s.Equal(string(auth.ReasonTokenBindingMismatch), problemCode(w))
+	w = refresh(key)
+	s.Equal(http.StatusOK, w.Code)
+
+	// Logging out requires a proof as well
+	req := httptest.NewRequest(http.MethodPost, "http://auth.example.com/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Access)
+	w = httptest.NewRecorder()
+	handler.Logout(w, req)
+	s.Equal(string(auth.ReasonTokenBindingMismatch), problemCode(w))
+}
+
+func (s *AuthTestSuite) TestDPoPForwardedRequest() {
+	viper.Set("auth.dpop.enabled", true)
+	viper.Set("server.trusted_proxies", []string{"10.0.0.0/8"})
+	defer viper.Set("auth.dpop.enabled", false)
+	defer viper.Set("server.trusted_proxies", nil)
+	handler := auth.NewAuthHandler(s.service, s.tenants, dpop.NewVerifier(s.repo))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	login := func(nonce string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"sub": "1"})
+		req := httptest.NewRequest(http.MethodPost, "http://auth.example.com/login", bytes.NewBuffer(body))
+		req.Header.Set("DPoP", newDPoPProof(s, key, http.MethodPost, "http://auth.example.com/login", "", nonce))
+		w := httptest.NewRecorder()
+		handler.Login(w, req)
+		return w
+	}
+	w := login(login("").Header().Get("DPoP-Nonce"))
+	s.Require().Equal(http.StatusOK, w.Code)
+	nonce := w.Header().Get("DPoP-Nonce")
+	var tokens auth.TokenPair
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	// The proof was made for an API request, which a proxy asks about
+	authenticate := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://jwt:8080/authenticate", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "DPoP "+tokens.Access)
+		req.Header.Set("DPoP", newDPoPProof(s, key, http.MethodDelete, "https://api.example.com/orders/1", tokens.Access, nonce))
+		req.Header.Set("X-Forwarded-Method", http.MethodDelete)
+		req.Header.Set("X-Original-URL", "https://api.example.com/orders/1")
+		w := httptest.NewRecorder()
+		handler.Authenticate(w, req)
+		return w
+	}
+
+	// Other peers cannot claim to relay the request the proof was made for
+	w = authenticate("192.0.2.1:1234")
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal(string(auth.ReasonInvalidDPoPProof), problemCode(w))
+
+	w = authenticate("10.0.0.5:1234")
+	s.Equal(http.StatusOK, w.Code)
+}
+
+func (s *AuthTestSuite) TestTokenExchange() {
+	viper.Set("token_exchange.enabled", true)
+	viper.Set("token_exchange.policies", []map[string]interface{}{
+		{"actor": "svc-orders", "subjects": []string{"*"}, "scopes": []string{"orders:read"}},
+		{"actor": "svc-reports", "subjects": []string{"*"}, "scopes": []string{"orders:read"}},
+		{"actor": "support", "subjects": []string{"*"}, "scopes": []string{"*"}, "impersonate": true},
+	})
+	defer viper.Set("token_exchange.enabled", false)
+	defer viper.Set("token_exchange.policies", nil)
+	service := auth.NewAuthService(s.repo)
+	handler := auth.NewAuthHandler(service, s.tenants, dpop.NewVerifier(s.repo))
+	def := s.tenants.Default()
+
+	user, err := service.Login(context.Background(), def, &authjwt.Grant{Subject: "1", Scope: "orders:read orders:write profile"})
+	s.Require().NoError(err)
+	orders, err := service.Login(context.Background(), def, &authjwt.Grant{Subject: "svc-orders"})
+	s.Require().NoError(err)
+	support, err := service.Login(context.Background(), def, &authjwt.Grant{Subject: "support", Scope: "profile tickets"})
+	s.Require().NoError(err)
+	billing, err := service.Login(context.Background(), def, &authjwt.Grant{Subject: "svc-billing"})
+	s.Require().NoError(err)
+
+	exchange := func(params map[string]string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		form := url.Values{"grant_type": {auth.GrantTypeTokenExchange}}
+		for key, value := range params {
+			form.Set(key, value)
+			if key == "subject_token" || key == "actor_token" {
+				form.Set(key+"_type", auth.TokenTypeAccessToken)
+			}
+		}
+		req := httptest.NewRequest(http.MethodPost, "/token-exchange", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.TokenExchange(w, req)
+
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+
+	// Delegation narrows the token to the scopes the policy grants the actor
+	w, resp := exchange(map[string]string{"subject_token": user.Access, "actor_token": orders.Access})
+	s.Require().Equal(http.StatusOK, w.Code)
+	s.Equal(auth.TokenTypeAccessToken, resp["issued_token_type"])
+	s.Equal("Bearer", resp["token_type"])
+	s.Equal("orders:read", resp["scope"])
+	delegated := resp["access_token"].(string)
+
+	claims, err := service.Authenticate(context.Background(), def, delegated, nil, nil)
+	s.Require().NoError(err)
+	s.Equal("1", claims.Subject)
+	s.Equal("exchanged", claims.Type)
+	s.Equal(&authjwt.Actor{Subject: "svc-orders"}, claims.Actor)
+
+	// Exchanged tokens expire with the actor token when it expires first
+	shortLived := *def
+	shortLived.AccessLifetime = time.Minute
+	reports, err := service.Login(context.Background(), &shortLived, &authjwt.Grant{Subject: "svc-reports"})
+	s.Require().NoError(err)
+	w, resp = exchange(map[string]string{"subject_token": user.Access, "actor_token": reports.Access})
+	s.Require().Equal(http.StatusOK, w.Code)
+	s.LessOrEqual(resp["expires_in"], float64(60))
+	claims, err = service.Authenticate(context.Background(), def, resp["access_token"].(string), nil, nil)
+	s.Require().NoError(err)
+	s.LessOrEqual(time.Until(claims.ExpiresAt.Time), time.Minute)
+
+	w, _ = exchange(map[string]string{"subject_token": user.Access, "actor_token": orders.Access, "scope": "orders:write"})
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Equal(string(auth.ReasonInvalidScope), problemCode(w))
+
+	// Actors without a policy cannot exchange tokens
+	w, _ = exchange(map[string]string{"subject_token": user.Access, "actor_token": billing.Access})
+	s.Equal(http.StatusForbidden, w.Code)
+	s.Equal(string(auth.ReasonExchangeNotPermitted), problemCode(w))
+
+	// Subjects can narrow their own tokens
+	w, resp = exchange(map[string]string{"subject_token": user.Access, "scope": "profile"})
+	s.Require().Equal(http.StatusOK, w.Code)
+	claims, err = service.Authenticate(context.Background(), def, resp["access_token"].(string), nil, nil)
+	s.Require().NoError(err)
+	s.Equal("profile", claims.Scope)
+	s.Nil(claims.Actor)
+
+	// Only permitted actors may impersonate
+	w, resp = exchange(map[string]string{"requested_subject": "42", "actor_token": support.Access, "scope": "profile"})
+	s.Require().Equal(http.StatusOK, w.Code)
+	claims, err = service.Authenticate(context.Background(), def, resp["access_token"].(string), nil, nil)
+	s.Require().NoError(err)
+	s.Equal("42", claims.Subject)
+	s.Equal("support", claims.Actor.Subject)
+
+	w, _ = exchange(map[string]string{"requested_subject": "42", "actor_token": orders.Access})
+	s.Equal(string(auth.ReasonExchangeNotPermitted), problemCode(w))
+
+	// Without a requested scope, an unrestricted impersonation gets the scope of the actor token
+	w, resp = exchange(map[string]string{"requested_subject": "42", "actor_token": support.Access})
+	s.Require().Equal(http.StatusOK, w.Code)
+	s.Equal("profile tickets", resp["scope"])
+
+	// Delegated tokens can be delegated further, recording the chain
+	w, resp = exchange(map[string]string{"subject_token": delegated, "actor_token": support.Access})
+	s.Require().Equal(http.StatusOK, w.Code)
+	claims, err = service.Authenticate(context.Background(), def, resp["access_token"].(string), nil, nil)
+	s.Require().NoError(err)
+	s.Equal(&authjwt.Actor{Subject: "support", Actor: &authjwt.Actor{Subject: "svc-orders"}}, claims.Actor)
+	s.Equal("orders:read", claims.Scope)
+
+	// Exchanged tokens cannot be refreshed, and revoking one leaves the session of the subject intact
+	_, err = service.Refresh(context.Background(), def, delegated, nil)
+	s.ErrorIs(err, auth.ErrInvalidTokenType)
+	s.Require().NoError(service.Logout(context.Background(), def, delegated, nil))
+	_, err = service.Authenticate(context.Background(), def, delegated, nil, nil)
+	s.ErrorIs(err, auth.ErrTokenRevoked)
+	_, err = service.Authenticate(context.Background(), def, user.Access, nil, nil)
+	s.NoError(err)
+
+	w, _ = exchange(map[string]string{"subject_token": user.Access, "grant_type": "password"})
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *AuthTestSuite) TestStepUpAuthentication() {
+	viper.Set("auth.step_up.acr_levels", []string{"pwd", "mfa", "hwk"})
+	defer viper.Set("auth.step_up.acr_levels", nil)
+	service := auth.NewAuthService(s.repo)
+	handler := auth.NewAuthHandler(service, s.tenants, dpop.NewVerifier(s.repo))
+
+	login := func(params map[string]interface{}) (*httptest.ResponseRecorder, *auth.TokenPair) {
+		params["sub"] = "1"
+		body, _ := json.Marshal(params)
+		w := httptest.NewRecorder()
+		handler.Login(w, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+
+		var tokenPair auth.TokenPair
+		json.Unmarshal(w.Body.Bytes(), &tokenPair)
+		return w, &tokenPair
+	}
+	authenticate := func(token, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/authenticate?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.Authenticate(w, req)
+		return w
+	}
+
+	w, password := login(map[string]interface{}{"acr": "pwd", "amr": []string{"pwd"}})
+	s.Require().Equal(http.StatusOK, w.Code)
+	w = authenticate(password.Access, "")
+	s.Require().Equal(http.StatusOK, w.Code)
+	var claims authjwt.JWTClaims
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &claims))
+	s.Equal("pwd", claims.ACR)
+	s.Equal([]string{"pwd"}, claims.AMR)
+	s.Require().NotNil(claims.AuthTime)
+	s.WithinDuration(time.Now(), claims.AuthTime.Time, 2*time.Second)
+
+	// Weaker classes get a challenge naming the required class
+	w = authenticate(password.Access, "acr_values=mfa")
+	s.Equal(http.StatusUnauthorized, w.Code)
+	s.Equal(string(auth.ReasonStepUpRequired), problemCode(w))
+	s.Contains(w.Header().Get("WWW-Authenticate"), `error="insufficient_user_authentication"`)
+	s.Contains(w.Header().Get("WWW-Authenticate"), `acr_values="mfa"`)
+
+	// Stronger classes satisfy weaker requirements, unknown classes only match themselves
+	_, hardware := login(map[string]interface{}{"acr": "hwk"})
+	s.Equal(http.StatusOK, authenticate(hardware.Access, "acr_values=mfa").Code)
+	_, custom := login(map[string]interface{}{"acr": "urn:example:custom"})
+	s.Equal(http.StatusUnauthorized, authenticate(custom.Access, "acr_values=pwd").Code)
+	s.Equal(http.StatusOK, authenticate(custom.Access, "acr_values=mfa+urn:example:custom").Code)
+
+	// Authentications older than max_age require a new login, also after refreshing
+	_, earlier := login(map[string]interface{}{"auth_time": time.Now().Add(-10 * time.Minute).Unix()})
+	w = authenticate(earlier.Access, "max_age=300")
+	s.Equal(string(auth.ReasonStepUpRequired), problemCode(w))
+	s.Contains(w.Header().Get("WWW-Authenticate"), `max_age="300"`)
+	s.Equal(http.StatusOK, authenticate(earlier.Access, "max_age=900").Code)
+
+	refreshed, err := service.Refresh(context.Background(), s.tenants.Default(), earlier.Refresh, nil)
+	s.Require().NoError(err)
+	s.Equal(string(auth.ReasonStepUpRequired), problemCode(authenticate(refreshed.Access, "max_age=300")))
+
+	s.Equal(http.StatusBadRequest, authenticate(password.Access, "max_age=soon").Code)
+	w, _ = login(map[string]interface{}{"auth_time": time.Now().Add(time.Hour).Unix()})
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	// Forward auth reads the requirement from its own URL
+	req := httptest.NewRequest(http.MethodGet, "/forward-auth?max_age=300", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshed.Access)
+	w = httptest.NewRecorder()
+	handler.ForwardAuth(w, req)
+	s.Equal(string(auth.ReasonStepUpRequired), problemCode(w))
+
+	// Rejected tokens do not keep their session alive. Extensions are written when the repo is closed.
+	viper.Set("cache.background.flush_interval", time.Hour)
+	defer viper.Set("cache.background.flush_interval", nil)
+	repo := auth.NewAuthRepo(s.mockCache.Cache())
+	key := s.tenants.Default().CacheKey("token-1")
+	cache := s.mockCache.Cache()
+	s.Require().NoError(cache.Expire(context.Background(), key, time.Minute).Err())
+	_, err = auth.NewAuthService(repo).Authenticate(context.Background(), s.tenants.Default(), refreshed.Access, nil,
+		&auth.AuthnRequirement{MaxAge: 5 * time.Minute})
+	s.ErrorIs(err, auth.ErrStepUpRequired)
+	s.Require().NoError(repo.Close(context.Background()))
+	ttl, err := cache.TTL(context.Background(), key).Result()
+	s.Require().NoError(err)
+	s.LessOrEqual(ttl, time.Minute)
+}
+
+func (s *AuthTestSuite) TestMetrics() {
+	def := s.tenants.Default()
+	logins := testutil.ToFloat64(metrics.Logins.WithLabelValues(def.ID))
+	refreshes := testutil.ToFloat64(metrics.Refreshes.WithLabelValues(def.ID))
+	missing := testutil.ToFloat64(metrics.Failures.WithLabelValues(string(auth.ReasonMissingToken)))
+
+	tokenPair, err := s.service.Login(context.Background(), def, &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+	_, err = s.service.Login(context.Background(), def, &authjwt.Grant{Subject: "2"})
+	s.Require().NoError(err)
+	_, err = s.service.Refresh(context.Background(), def, tokenPair.Refresh, nil)
+	s.Require().NoError(err)
+
+	s.Equal(logins+2, testutil.ToFloat64(metrics.Logins.WithLabelValues(def.ID)))
+	s.Equal(refreshes+1, testutil.ToFloat64(metrics.Refreshes.WithLabelValues(def.ID)))
+
+	w := httptest.NewRecorder()
+	s.handler.Authenticate(w, httptest.NewRequest(http.MethodGet, "/authenticate", nil))
+	s.Equal(missing+1, testutil.ToFloat64(metrics.Failures.WithLabelValues(string(auth.ReasonMissingToken))))
+
+	// Sessions are counted per tenant
+	acme, err := s.tenants.Get("acme")
+	s.Require().NoError(err)
+	_, err = s.service.Login(context.Background(), acme, &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	count, err := s.repo.CountSessions(context.Background(), def)
+	s.Require().NoError(err)
+	s.Equal(int64(2), count)
+	count, err = s.repo.CountSessions(context.Background(), acme)
+	s.Require().NoError(err)
+	s.Equal(int64(1), count)
+
+	// Tenant IDs are matched literally
+	for _, id := range []string{"ac?e", "a*", "[a]cme", `acm\e`} {
+		count, err = s.repo.CountSessions(context.Background(), &tenant.Tenant{ID: id})
+		s.Require().NoError(err)
+		s.Zero(count, id)
+	}
+	glob := &tenant.Tenant{ID: "a*"}
+	s.Require().NoError(s.mockCache.Cache().Set(context.Background(), glob.CacheKey("token-1"), "{}", time.Minute).Err())
+	count, err = s.repo.CountSessions(context.Background(), glob)
+	s.Require().NoError(err)
+	s.Equal(int64(1), count)
+}
+
+func (s *AuthTestSuite) TestTracing() {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	tokenPair, err := s.service.Login(context.Background(), s.tenants.Default(), &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "request")
+	_, err = s.service.Authenticate(ctx, s.tenants.Default(), tokenPair.Access, nil, nil)
+	s.Require().NoError(err)
+	root.End()
+
+	// Every layer records a span within the trace of the request
+	names := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == root.SpanContext().TraceID() {
+			names[span.Name()] = true
+		}
+	}
+	s.True(names["AuthService.Authenticate"])
+	s.True(names["JWTService.ParseToken"])
+	s.True(names["AuthRepo.IsTokenCached"])
+}
+
+func (s *AuthTestSuite) TestDeadlines() {
+	def := s.tenants.Default()
+	tokenPair, err := s.service.Login(context.Background(), def, &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	// A request that is gone stops waiting on the cache
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.service.Authenticate(cancelled, def, tokenPair.Access, nil, nil)
+	s.ErrorIs(err, auth.ErrCacheUnavailable)
+
+	// Operations are bounded by their own timeout
+	viper.Set("cache.timeouts.read", time.Nanosecond)
+	defer viper.Set("cache.timeouts.read", nil)
+	repo := auth.NewAuthRepo(s.mockCache.Cache())
+	defer repo.Close(context.Background())
+	_, err = auth.NewAuthService(repo).Authenticate(context.Background(), def, tokenPair.Access, nil, nil)
+	s.ErrorIs(err, auth.ErrCacheUnavailable)
+
+	// Revocation completes even when the client disconnects
+	s.Require().NoError(s.repo.DeleteTokenPair(cancelled, def, "1"))
+	_, err = s.service.Authenticate(context.Background(), def, tokenPair.Access, nil, nil)
+	s.ErrorIs(err, auth.ErrTokenRevoked)
+}
+
+func (s *AuthTestSuite) TestSessionExtension() {
+	// Nothing is flushed until the repo is closed
+	viper.Set("cache.background.flush_interval", time.Hour)
+	viper.Set("cache.background.max_pending", 1)
+	defer viper.Set("cache.background.flush_interval", nil)
+	defer viper.Set("cache.background.max_pending", nil)
+	repo := auth.NewAuthRepo(s.mockCache.Cache())
+	service := auth.NewAuthService(repo)
+
+	def := s.tenants.Default()
+	tokenPair, err := service.Login(context.Background(), def, &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+	_, err = service.Login(context.Background(), def, &authjwt.Grant{Subject: "2"})
+	s.Require().NoError(err)
+
+	key := def.CacheKey("token-1")
+	cache := s.mockCache.Cache()
+	s.Require().NoError(cache.Expire(context.Background(), key, time.Minute).Err())
+
+	result := func(name string) float64 {
+		return testutil.ToFloat64(metrics.SessionExtensions.WithLabelValues(name))
+	}
+	written, coalesced, dropped := result(metrics.ExtensionWritten), result(metrics.ExtensionCoalesced), result(metrics.ExtensionDropped)
+
+	for range 3 {
+		_, err = service.Authenticate(context.Background(), def, tokenPair.Access, nil, nil)
+		s.Require().NoError(err)
+	}
+	// The queue holds a single session, so the second one is dropped
+	repo.ExtendTokenPairCacheExpiration(context.Background(), def, "2")
+	s.Equal(1.0, testutil.ToFloat64(metrics.SessionExtensionQueue))
+
+	s.Require().NoError(repo.Close(context.Background()))
+	s.Equal(written+1, result(metrics.ExtensionWritten))
+	s.Equal(coalesced+2, result(metrics.ExtensionCoalesced))
+	s.Equal(dropped+1, result(metrics.ExtensionDropped))
+	s.Equal(0.0, testutil.ToFloat64(metrics.SessionExtensionQueue))
+
+	ttl, err := cache.TTL(context.Background(), key).Result()
+	s.Require().NoError(err)
+	s.Greater(ttl, time.Hour)
+}
+
+func (s *AuthTestSuite) TestLocalVerificationCache() {
+	viper.Set("cache.local.enabled", true)
+	defer viper.Set("cache.local.enabled", false)
+
+	// Two instances sharing the cache
+	repos := []auth.AuthRepo{auth.NewAuthRepo(s.mockCache.Cache()), auth.NewAuthRepo(s.mockCache.Cache())}
+	services := []auth.AuthService{auth.NewAuthService(repos[0]), auth.NewAuthService(repos[1])}
+	defer repos[0].Close(context.Background())
+	defer repos[1].Close(context.Background())
+
+	def := s.tenants.Default()
+	tokenPair, err := services[0].Login(context.Background(), def, &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	hits := func() float64 { return testutil.ToFloat64(metrics.VerificationCache.WithLabelValues(metrics.CacheHit)) }
+	authenticate := func(service auth.AuthService) error {
+		_, err := service.Authenticate(context.Background(), def, tokenPair.Access, nil, nil)
+		return err
+	}
+
+	// Once subscribed, the second check of a token is served locally
+	cachedLocally := func() bool {
+		before := hits()
+		return authenticate(services[1]) == nil && authenticate(services[1]) == nil && hits() == before+1
+	}
+	s.Eventually(cachedLocally, time.Second, 10*time.Millisecond)
+
+	// Deleting the session behind the back of the instance does not reach the local cache
+	s.Require().NoError(s.mockCache.Cache().Del(context.Background(), def.CacheKey("token-1")).Err())
+	s.NoError(authenticate(services[1]))
+
+	// Replacing the session does, and the token is cached again afterwards
+	s.Require().NoError(repos[0].CacheTokenPair(context.Background(), def, tokenPair))
+	s.Eventually(cachedLocally, time.Second, 10*time.Millisecond)
+
+	// A logout on one instance is applied by the other
+	s.Require().NoError(services[0].Logout(context.Background(), def, tokenPair.Access, nil))
+	s.Eventually(func() bool {
+		return errors.Is(authenticate(services[1]), auth.ErrTokenRevoked)
+	}, time.Second, 10*time.Millisecond)
+
+	// Refresh tokens are not cached locally
+	_, err = services[1].Refresh(context.Background(), def, tokenPair.Refresh, nil)
+	s.ErrorIs(err, auth.ErrTokenRevoked)
+}
+
+func (s *AuthTestSuite) TestDegradedMode() {
+	viper.Set("auth.degraded.enabled", true)
+	viper.Set("auth.degraded.max_token_age", time.Hour)
+	defer viper.Set("auth.degraded.enabled", false)
+	defer viper.Set("auth.degraded.max_token_age", nil)
+
+	def := s.tenants.Default()
+	tokenPair, err := s.service.Login(context.Background(), def, &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	// Nothing listens on port 1, the breaker opens after the first failure
+	down := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	down.AddHook(cache.BreakerHook(breaker.New("degraded-test", 1, time.Hour)))
+	defer down.Close()
+	repo := auth.NewAuthRepo(down)
+	defer repo.Close(context.Background())
+	service := auth.NewAuthService(repo)
+
+	_, err = service.Authenticate(context.Background(), def, tokenPair.Access, nil, nil)
+	s.ErrorIs(err, auth.ErrCacheUnavailable)
+
+	accepted := testutil.ToFloat64(metrics.DegradedDecisions.WithLabelValues(metrics.DegradedAccepted))
+	authn, err := service.Authenticate(context.Background(), def, tokenPair.Access, nil, nil)
+	s.Require().NoError(err)
+	s.True(authn.Degraded)
+	s.Equal("1", authn.Subject)
+	s.Equal(accepted+1, testutil.ToFloat64(metrics.DegradedDecisions.WithLabelValues(metrics.DegradedAccepted)))
+
+	handler := auth.NewAuthHandler(service, s.tenants, dpop.NewVerifier(repo))
+	req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenPair.Access)
+	w := httptest.NewRecorder()
+	handler.Authenticate(w, req)
+	s.Equal(http.StatusOK, w.Code)
+	s.Equal("true", w.Header().Get(auth.DegradedHeader))
+
+	// Invalid tokens are still rejected
+	_, err = service.Authenticate(context.Background(), def, tokenPair.Refresh, nil, nil)
+	s.ErrorIs(err, auth.ErrInvalidTokenType)
+
+	// Tokens logged out on this instance are denied even though Redis was not updated
+	s.ErrorIs(service.Logout(context.Background(), def, tokenPair.Access, nil), auth.ErrCacheUnavailable)
+	_, err = service.Authenticate(context.Background(), def, tokenPair.Access, nil, nil)
+	s.ErrorIs(err, auth.ErrTokenRevoked)
+
+	// Tokens older than the maximum age are not accepted
+	viper.Set("auth.degraded.max_token_age", time.Nanosecond)
+	other, err := s.service.Login(context.Background(), def, &authjwt.Grant{Subject: "2"})
+	s.Require().NoError(err)
+	_, err = auth.NewAuthService(repo).Authenticate(context.Background(), def, other.Access, nil, nil)
+	s.ErrorIs(err, auth.ErrCacheUnavailable)
+
+	// Without the policy the request fails as before
+	viper.Set("auth.degraded.enabled", false)
+	_, err = auth.NewAuthService(repo).Authenticate(context.Background(), def, other.Access, nil, nil)
+	s.ErrorIs(err, auth.ErrCacheUnavailable)
+	s.ErrorIs(err, breaker.ErrOpen)
+}
+
+func (s *AuthTestSuite) TestLogoutFailure() {
+	def := s.tenants.Default()
+	tokenPair, err := s.service.Login(context.Background(), def, &authjwt.Grant{Subject: "1"})
+	s.Require().NoError(err)
+
+	// Nothing listens on port 1
+	down := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer down.Close()
+	repo := auth.NewAuthRepo(down)
+	defer repo.Close(context.Background())
+	handler := auth.NewAuthHandler(auth.NewAuthService(repo), s.tenants, dpop.NewVerifier(repo))
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenPair.Access)
+	w := httptest.NewRecorder()
+	handler.Logout(w, req)
+	s.Equal(http.StatusServiceUnavailable, w.Code)
+	s.Equal(string(auth.ReasonCacheUnavailable), problemCode(w))
+
+	// The session is still alive, which the caller has been told
+	_, err = s.service.Authenticate(context.Background(), def, tokenPair.Access, nil, nil)
+	s.NoError(err)
+}
+
+func (s *AuthTestSuite) TestRateLimit() {
+	rules := []ratelimit.Rule{{Key: ratelimit.KeyUser, Limit: 2, Period: time.Minute, Burst: 2}}
+	keys := map[string]ratelimit.KeyFunc{ratelimit.KeyUser: s.handler.RateLimitSubject}
+	// Two instances sharing Redis
+	login := []http.Handler{
+		ratelimit.Middleware(ratelimit.NewLimiter(s.mockCache.Cache()), "login", rules, keys)(http.HandlerFunc(s.handler.Login)),
+		ratelimit.Middleware(ratelimit.NewLimiter(s.mockCache.Cache()), "login", rules, keys)(http.HandlerFunc(s.handler.Login)),
+	}
+
+	request := func(instance int, sub string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"sub":"`+sub+`"}`))
+		w := httptest.NewRecorder()
+		login[instance].ServeHTTP(w, req)
+		return w
+	}
+
+	// The body read for the subject is still available to the handler
+	s.Equal(http.StatusOK, request(0, "alice").Code)
+	s.Equal(http.StatusOK, request(1, "alice").Code)
+	w := request(0, "alice")
+	s.Equal(http.StatusTooManyRequests, w.Code)
+	s.Equal(ratelimit.CodeRateLimited, problemCode(w))
+	s.Equal("30", w.Header().Get("Retry-After"))
+	s.Equal(http.StatusOK, request(1, "bob").Code)
+
+	// Refresh tokens count against their subject, unless they are forged
+	def := s.tenants.Default()
+	tokenPair, err := s.service.Login(context.Background(), def, &authjwt.Grant{Subject: "carol"})
+	s.Require().NoError(err)
+	refresh := func(token string) (string, bool) {
+		req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{"refresh":"`+token+`"}`))
+		return s.handler.RateLimitSubject("refresh", req)
+	}
+	subject, ok := refresh(tokenPair.Refresh)
+	s.True(ok)
+	s.Equal(def.ID+":carol", subject)
+
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "carol", "iss": def.Issuer}).SignedString([]byte("guessed"))
+	s.Require().NoError(err)
+	_, ok = refresh(forged)
+	s.False(ok)
+}
+
+func (s *AuthTestSuite) TestAuditEvents() {
+	viper.Set("token_exchange.enabled", true)
+	viper.Set("token_exchange.policies", []map[string]interface{}{
+		{"actor": "support", "subjects": []string{"*"}, "scopes": []string{"*"}, "impersonate": true},
+	})
+	defer viper.Set("token_exchange.enabled", false)
+	defer viper.Set("token_exchange.policies", nil)
+	handler := auth.NewAuthHandler(auth.NewAuthService(s.repo), s.tenants, dpop.NewVerifier(s.repo))
+	support, err := s.service.Login(context.Background(), s.tenants.Default(), &authjwt.Grant{Subject: "support", Scope: "tickets"})
+	s.Require().NoError(err)
+
+	var buf bytes.Buffer
+	logger := audit.NewLogger([]audit.Sink{
+		audit.NewWriterSink("buffer", &buf),
+		audit.NewRedisStreamSink(s.mockCache.Cache(), "audit", 1000),
+	}, []byte("audit-test-key"), 100, time.Second)
+	audit.SetDefault(logger)
+	defer audit.SetDefault(nil)
+
+	serve := func(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("User-Agent", "audit-test")
+		w := httptest.NewRecorder()
+		middleware.Chain(handler, middleware.RequestID(), middleware.ClientIP(nil), audit.Middleware()).ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(s.handler.Login, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"sub":"alice"}`)))
+	s.Require().Equal(http.StatusOK, w.Code)
+	var tokenPair auth.TokenPair
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &tokenPair))
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{"refresh":"`+tokenPair.Refresh+`"}`))
+	s.Require().Equal(http.StatusOK, serve(s.handler.Refresh, req).Code)
+	// The rotated refresh token has been revoked
+	req = httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{"refresh":"`+tokenPair.Refresh+`"}`))
+	s.Require().Equal(http.StatusUnauthorized, serve(s.handler.Refresh, req).Code)
+	req = httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenPair.Access)
+	s.Require().Equal(http.StatusUnauthorized, serve(s.handler.Authenticate, req).Code)
+	req = httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	s.Require().Equal(http.StatusUnauthorized, serve(s.handler.Logout, req).Code)
+	// Requests without credentials are rejected before reaching the service
+	req = httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	s.Require().Equal(http.StatusUnauthorized, serve(s.handler.Authenticate, req).Code)
+
+	exchange := func(form url.Values) int {
+		form.Set("grant_type", auth.GrantTypeTokenExchange)
+		form.Set("actor_token", support.Access)
+		form.Set("actor_token_type", auth.TokenTypeAccessToken)
+		req := httptest.NewRequest(http.MethodPost, "/token-exchange", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(handler.TokenExchange, req).Code
+	}
+	s.Require().Equal(http.StatusOK, exchange(url.Values{"requested_subject": {"bob"}}))
+	s.Require().Equal(http.StatusUnauthorized, exchange(url.Values{"subject_token": {"not-a-token"}, "subject_token_type": {auth.TokenTypeAccessToken}}))
+
+	s.Require().NoError(logger.Close(context.Background()))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var events []audit.Event
+	for _, line := range lines {
+		var event audit.Event
+		s.Require().NoError(json.Unmarshal([]byte(line), &event))
+		events = append(events, event)
+	}
+	s.Require().Len(events, 8)
+
+	type summary struct{ Type, Subject, Actor, Scope, Outcome, Reason string }
+	var summaries []summary
+	for _, event := range events {
+		summaries = append(summaries, summary{event.Type, event.Subject, event.Actor, event.Scope, event.Outcome, event.Reason})
+		s.Equal(s.tenants.Default().ID, event.Tenant)
+		s.Equal("192.0.2.1", event.ClientIP)
+		s.Equal("audit-test", event.UserAgent)
+		s.NotEmpty(event.RequestID)
+	}
+	s.Equal([]summary{
+		{audit.TypeLogin, "alice", "", "", audit.OutcomeSuccess, ""},
+		{audit.TypeRefresh, "alice", "", "", audit.OutcomeSuccess, ""},
+		{audit.TypeRefresh, "alice", "", "", audit.OutcomeFailure, string(auth.ReasonTokenRevoked)},
+		{audit.TypeAuthentication, "alice", "", "", audit.OutcomeFailure, string(auth.ReasonTokenRevoked)},
+		{audit.TypeLogout, "", "", "", audit.OutcomeFailure, string(auth.ReasonTokenMalformed)},
+		{audit.TypeAuthentication, "", "", "", audit.OutcomeFailure, string(auth.ReasonMissingToken)},
+		{audit.TypeImpersonation, "bob", "support", "tickets", audit.OutcomeSuccess, ""},
+		{audit.TypeExchange, "", "support", "", audit.OutcomeFailure, string(auth.ReasonTokenMalformed)},
+	}, summaries)
+	s.NotEmpty(events[0].Session)
+	s.Equal(events[1].Session, events[2].Session)
+
+	count, err := audit.Verify(strings.NewReader(strings.Join(lines, "\n")), []byte("audit-test-key"))
+	s.NoError(err)
+	s.Equal(8, count)
+
+	// The Redis stream holds the same events
+	entries, err := s.mockCache.Cache().XRange(context.Background(), "audit", "-", "+").Result()
+	s.Require().NoError(err)
+	s.Require().Len(entries, 8)
+	s.JSONEq(lines[0], entries[0].Values["event"].(string))
 }
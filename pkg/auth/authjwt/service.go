@@ -1,83 +1,229 @@
 package authjwt
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"strconv"
 	"time"
 
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tracing"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var ErrInvalidToken = errors.New("invalid token")
+// Token errors are always joined with ErrInvalidToken, so callers that do not care
+// about the cause can keep checking for it alone.
+var (
+	ErrInvalidToken          = errors.New("invalid token")
+	ErrTokenMalformed        = errors.New("token malformed")
+	ErrTokenSignatureInvalid = errors.New("token signature invalid")
+	ErrTokenExpired          = errors.New("token expired")
+	ErrTokenNotYetValid      = errors.New("token not yet valid")
+	ErrTokenIssuerInvalid    = errors.New("token issuer invalid")
+	ErrInvalidSubject        = errors.New("invalid subject")
+)
 
 type JWTClaims struct {
-	UserID uint   `json:"user_id"`
-	UID    string `json:"uid"`
-	Type   string `json:"type"`
+	// UserID is the legacy numeric subject claim. New consumers should use Subject.
+	UserID json.Number `json:"user_id,omitempty"`
+	UID    string      `json:"uid"`
+	Type   string      `json:"type"`
+	Scope  string      `json:"scope,omitempty"`
+	// Confirmation binds the token to a key of its sender, see RFC 7800.
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	// Actor is the party acting on behalf of the subject of an exchanged token, see RFC 8693.
+	Actor *Actor `json:"act,omitempty"`
+	// AuthTime, ACR and AMR describe when and how the subject authenticated, as in OpenID Connect.
+	// Refreshed tokens keep them, so only a new login makes the authentication more recent.
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	ACR      string           `json:"acr,omitempty"`
+	AMR      []string         `json:"amr,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Actor records a delegation chain. The outermost actor is the current one,
+// nested actors are the prior parties the token was delegated through.
+type Actor struct {
+	Subject string `json:"sub"`
+	Actor   *Actor `json:"act,omitempty"`
+}
+
+// Depth returns the number of actors in the chain.
+func (a *Actor) Depth() int {
+	depth := 0
+	for ; a != nil; a = a.Actor {
+		depth++
+	}
+	return depth
+}
+
+// Confirmation names the key a sender has to prove possession of to use a token.
+type Confirmation struct {
+	X5TS256 string `json:"x5t#S256,omitempty"` // client certificate thumbprint, RFC 8705
+	JKT     string `json:"jkt,omitempty"`      // DPoP key thumbprint, RFC 9449
+}
+
+// Grant describes whom a token pair is issued to and what it allows.
+type Grant struct {
+	Subject string
+	Scope   string // space-delimited list of scopes
+	// Confirmation binds the issued tokens to a key of the client, nil for bearer tokens.
+	Confirmation *Confirmation
+	Actor        *Actor
+	AuthTime     time.Time // when the subject authenticated, zero if unknown
+	ACR          string    // authentication context class reference
+	AMR          []string  // authentication methods references, e.g. pwd, otp, hwk
+}
+
+// GrantFromClaims restores the grant a token was issued for, so that refreshed tokens keep it.
+func GrantFromClaims(claims *JWTClaims) *Grant {
+	return &Grant{
+		Subject:      claims.Subject,
+		Scope:        claims.Scope,
+		Confirmation: claims.Confirmation,
+		Actor:        claims.Actor,
+		AuthTime:     authTime(claims.AuthTime),
+		ACR:          claims.ACR,
+		AMR:          claims.AMR,
+	}
+}
+
+func authTime(date *jwt.NumericDate) time.Time {
+	if date == nil {
+		return time.Time{}
+	}
+	return date.Time
+}
+
 type JWTService interface {
-	NewAccessToken(userID uint) (string, error)
-	NewRefreshToken(userID uint) (string, error)
-	ParseToken(tokenString string) (*JWTClaims, error)
+	NewAccessToken(ctx context.Context, t *tenant.Tenant, grant *Grant) (string, error)
+	NewRefreshToken(ctx context.Context, t *tenant.Tenant, grant *Grant) (string, error)
+	NewExchangedToken(ctx context.Context, t *tenant.Tenant, grant *Grant, lifetime time.Duration) (string, error)
+	ParseToken(ctx context.Context, t *tenant.Tenant, tokenString string) (*JWTClaims, error)
 }
 
+var tracer = otel.Tracer("github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt")
+
 type JWTServiceImpl struct{}
 
 func NewJWTService() JWTService {
 	return &JWTServiceImpl{}
 }
 
-func (s *JWTServiceImpl) NewAccessToken(userID uint) (string, error) {
-	claims := newAccessJWTClaims(userID)
-	return newSignedJWT(claims)
+func (s *JWTServiceImpl) NewAccessToken(ctx context.Context, t *tenant.Tenant, grant *Grant) (string, error) {
+	return s.newToken(ctx, "JWTService.NewAccessToken", t, grant, newAccessJWTClaims)
 }
 
-func (s *JWTServiceImpl) NewRefreshToken(userID uint) (string, error) {
-	claims := newRefreshJWTClaims(userID)
-	return newSignedJWT(claims)
+func (s *JWTServiceImpl) NewRefreshToken(ctx context.Context, t *tenant.Tenant, grant *Grant) (string, error) {
+	return s.newToken(ctx, "JWTService.NewRefreshToken", t, grant, newRefreshJWTClaims)
 }
 
-func (s *JWTServiceImpl) ParseToken(tokenString string) (*JWTClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(viper.GetString("secrets.jwt_key")), nil
+// NewExchangedToken issues a short-lived access token in a token exchange. Exchanged tokens
+// cannot be refreshed and are tracked apart from the session of their subject.
+func (s *JWTServiceImpl) NewExchangedToken(ctx context.Context, t *tenant.Tenant, grant *Grant, lifetime time.Duration) (string, error) {
+	return s.newToken(ctx, "JWTService.NewExchangedToken", t, grant, func(t *tenant.Tenant, grant *Grant) *JWTClaims {
+		return newJWTClaims(t, grant, "exchanged", lifetime)
 	})
+}
+
+func (s *JWTServiceImpl) newToken(ctx context.Context, name string, t *tenant.Tenant, grant *Grant, newClaims func(*tenant.Tenant, *Grant) *JWTClaims) (token string, err error) {
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(attribute.String("tenant", t.ID)))
+	defer func() { tracing.End(span, err) }()
+
+	if grant.Subject == "" {
+		return "", ErrInvalidSubject
+	}
+	return newSignedJWT(t, newClaims(t, grant))
+}
+
+func (s *JWTServiceImpl) ParseToken(ctx context.Context, t *tenant.Tenant, tokenString string) (claims *JWTClaims, err error) {
+	_, span := tracer.Start(ctx, "JWTService.ParseToken", trace.WithAttributes(attribute.String("tenant", t.ID)))
+	defer func() { tracing.End(span, err) }()
+
+	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return t.Key, nil
+	}, jwt.WithIssuer(t.Issuer), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
-		return nil, errors.Join(ErrInvalidToken, err)
+		return nil, errors.Join(ErrInvalidToken, classifyParseError(err), err)
+	}
+
+	claims, ok := token.Claims.(*JWTClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	// Tokens issued before the migration to sub only carry user_id
+	if claims.Subject == "" {
+		claims.Subject = claims.UserID.String()
 	}
+	if claims.Subject == "" {
+		return nil, errors.Join(ErrInvalidToken, ErrInvalidSubject)
+	}
+	return claims, nil
+}
 
-	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
-		return claims, nil
+// classifyParseError maps golang-jwt validation errors to the errors of this package.
+func classifyParseError(err error) error {
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return ErrTokenMalformed
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return ErrTokenSignatureInvalid
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return ErrTokenNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return ErrTokenIssuerInvalid
+	default:
+		return nil
 	}
-	return nil, ErrInvalidToken
 }
 
-func newSignedJWT(claims jwt.Claims) (string, error) {
+func newSignedJWT(t *tenant.Tenant, claims jwt.Claims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(viper.GetString("secrets.jwt_key")))
+	return token.SignedString(t.Key)
 }
 
-func newAccessJWTClaims(userID uint) *JWTClaims {
-	return newJWTClaims(userID, "access", viper.GetDuration("auth.access_lifetime"))
+func newAccessJWTClaims(t *tenant.Tenant, grant *Grant) *JWTClaims {
+	return newJWTClaims(t, grant, "access", t.AccessLifetime)
 }
 
-func newRefreshJWTClaims(userID uint) *JWTClaims {
-	return newJWTClaims(userID, "refresh", viper.GetDuration("auth.refresh_lifetime"))
+func newRefreshJWTClaims(t *tenant.Tenant, grant *Grant) *JWTClaims {
+	return newJWTClaims(t, grant, "refresh", t.RefreshLifetime)
 }
 
-func newJWTClaims(userID uint, tokenType string, lifetime time.Duration) *JWTClaims {
-	return &JWTClaims{
-		UserID: userID,
-		UID:    uuid.New().String(),
-		Type:   tokenType,
+func newJWTClaims(t *tenant.Tenant, grant *Grant, tokenType string, lifetime time.Duration) *JWTClaims {
+	claims := &JWTClaims{
+		UID:          uuid.New().String(),
+		Type:         tokenType,
+		Scope:        grant.Scope,
+		Confirmation: grant.Confirmation,
+		Actor:        grant.Actor,
+		ACR:          grant.ACR,
+		AMR:          grant.AMR,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   grant.Subject,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(lifetime)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    viper.GetString("auth.issuer"),
+			Issuer:    t.Issuer,
 		},
 	}
+
+	if !grant.AuthTime.IsZero() {
+		claims.AuthTime = jwt.NewNumericDate(grant.AuthTime)
+	}
+
+	// Only numeric subjects can be represented in the legacy claim
+	if _, err := strconv.ParseUint(grant.Subject, 10, 64); err == nil && t.LegacyUserIDClaim {
+		claims.UserID = json.Number(grant.Subject)
+	}
+	return claims
 }
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/mtls"
+)
+
+var ErrTokenBindingMismatch = errors.New("token is bound to another key")
+
+// Sender describes the keys the sender of a request has proven possession of.
+// Sender-constrained tokens are only accepted from a sender holding the key they are bound to.
+type Sender struct {
+	CertificateThumbprint string // x5t#S256 of the verified client certificate
+	KeyThumbprint         string // jkt of the key that signed the DPoP proof
+}
+
+// senderFromContext collects the client certificate verified by the TLS handshake
+// or forwarded by a trusted proxy.
+func senderFromContext(ctx context.Context) *Sender {
+	sender := &Sender{}
+	if identity, ok := mtls.FromContext(ctx); ok {
+		sender.CertificateThumbprint = identity.Thumbprint
+	}
+	return sender
+}
+
+// confirmationFor binds tokens to the keys of the sender: the DPoP key whenever a proof was presented,
+// and the client certificate when certificate binding is enabled. It returns nil for bearer tokens.
+func confirmationFor(sender *Sender, bindToCert bool) *authjwt.Confirmation {
+	if sender == nil {
+		return nil
+	}
+
+	cnf := &authjwt.Confirmation{JKT: sender.KeyThumbprint}
+	if bindToCert {
+		cnf.X5TS256 = sender.CertificateThumbprint
+	}
+	if cnf.JKT == "" && cnf.X5TS256 == "" {
+		return nil
+	}
+	return cnf
+}
+
+// verifyConfirmation checks that the sender holds every key a token is bound to.
+// Tokens without a confirmation claim are bearer tokens and accepted from anyone.
+func verifyConfirmation(claims *authjwt.JWTClaims, sender *Sender) error {
+	cnf := claims.Confirmation
+	if cnf == nil {
+		return nil
+	}
+	if sender == nil {
+		sender = &Sender{}
+	}
+
+	if cnf.X5TS256 != "" && !sameThumbprint(cnf.X5TS256, sender.CertificateThumbprint) {
+		return errors.Join(ErrInvalidToken, ErrTokenBindingMismatch)
+	}
+	if cnf.JKT != "" && !sameThumbprint(cnf.JKT, sender.KeyThumbprint) {
+		return errors.Join(ErrInvalidToken, ErrTokenBindingMismatch)
+	}
+	return nil
+}
+
+func sameThumbprint(expected, actual string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrMissingCookie    = errors.New("missing token cookie")
+	ErrInvalidCSRFToken = errors.New("invalid CSRF token")
+)
+
+// TokenCookies delivers token pairs to browser clients in HttpOnly cookies.
+// Cookie-borne credentials on unsafe methods are protected by a double-submit CSRF token:
+// the CSRF cookie is readable by scripts of the site and must be echoed in a request header.
+type TokenCookies interface {
+	Enabled() bool
+	Set(w http.ResponseWriter, t *tenant.Tenant, tokenPair *TokenPair) error
+	Clear(w http.ResponseWriter)
+	AccessToken(r *http.Request) (string, error)
+	RefreshToken(r *http.Request) (string, error)
+}
+
+type TokenCookiesImpl struct {
+	enabled     bool
+	domain      string
+	path        string
+	secure      bool
+	sameSite    http.SameSite
+	accessName  string
+	refreshName string
+	csrfName    string
+	csrfHeader  string
+}
+
+func NewTokenCookies() TokenCookies {
+	return &TokenCookiesImpl{
+		enabled:     viper.GetBool("auth.cookies.enabled"),
+		domain:      viper.GetString("auth.cookies.domain"),
+		path:        config.StringOrDefault("auth.cookies.path", "/"),
+		secure:      !viper.IsSet("auth.cookies.secure") || viper.GetBool("auth.cookies.secure"),
+		sameSite:    parseSameSite(viper.GetString("auth.cookies.same_site")),
+		accessName:  config.StringOrDefault("auth.cookies.access_name", "access_token"),
+		refreshName: config.StringOrDefault("auth.cookies.refresh_name", "refresh_token"),
+		csrfName:    config.StringOrDefault("auth.cookies.csrf_name", "csrf_token"),
+		csrfHeader:  config.StringOrDefault("auth.cookies.csrf_header", "X-CSRF-Token"),
+	}
+}
+
+func (c *TokenCookiesImpl) Enabled() bool {
+	return c.enabled
+}
+
+func (c *TokenCookiesImpl) Set(w http.ResponseWriter, t *tenant.Tenant, tokenPair *TokenPair) error {
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, c.cookie(c.accessName, tokenPair.Access, int(t.AccessLifetime.Seconds()), true))
+	http.SetCookie(w, c.cookie(c.refreshName, tokenPair.Refresh, int(t.RefreshLifetime.Seconds()), true))
+	http.SetCookie(w, c.cookie(c.csrfName, csrfToken, int(t.RefreshLifetime.Seconds()), false))
+	return nil
+}
+
+func (c *TokenCookiesImpl) Clear(w http.ResponseWriter) {
+	for _, name := range []string{c.accessName, c.refreshName, c.csrfName} {
+		http.SetCookie(w, c.cookie(name, "", -1, name != c.csrfName))
+	}
+}
+
+func (c *TokenCookiesImpl) AccessToken(r *http.Request) (string, error) {
+	return c.token(r, c.accessName)
+}
+
+func (c *TokenCookiesImpl) RefreshToken(r *http.Request) (string, error) {
+	return c.token(r, c.refreshName)
+}
+
+func (c *TokenCookiesImpl) token(r *http.Request, name string) (string, error) {
+	if !c.enabled {
+		return "", ErrMissingCookie
+	}
+
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return "", ErrMissingCookie
+	}
+
+	if !isSafeMethod(r.Method) {
+		if err := c.verifyCSRF(r); err != nil {
+			return "", err
+		}
+	}
+	return cookie.Value, nil
+}
+
+func (c *TokenCookiesImpl) verifyCSRF(r *http.Request) error {
+	cookie, err := r.Cookie(c.csrfName)
+	if err != nil || cookie.Value == "" {
+		return ErrInvalidCSRFToken
+	}
+
+	header := r.Header.Get(c.csrfHeader)
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
+
+func (c *TokenCookiesImpl) cookie(name, value string, maxAge int, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   c.domain,
+		Path:     c.path,
+		MaxAge:   maxAge,
+		Secure:   c.secure,
+		HttpOnly: httpOnly,
+		SameSite: c.sameSite,
+	}
+}
+
+func newCSRFToken() (string, error) {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func parseSameSite(mode string) http.SameSite {
+	switch strings.ToLower(mode) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteStrictMode
+	}
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnsupportedScheme    = errors.New("unsupported authorization scheme")
+	ErrMalformedCredentials = errors.New("malformed credentials")
+)
+
+const (
+	SchemeBearer = "Bearer"
+	SchemeDPoP   = "DPoP"
+)
+
+type CredentialSource string
+
+const (
+	SourceHeader CredentialSource = "header"
+	SourceCookie CredentialSource = "cookie"
+	SourceForm   CredentialSource = "form"
+)
+
+// Credential is an access token presented by a client together with how it was presented.
+type Credential struct {
+	Scheme string
+	Token  string
+	Source CredentialSource
+}
+
+// CredentialExtractor finds the access token of a request. Following RFC 6750, a request
+// must not present its token both in the Authorization header and in an access_token
+// form parameter of a POST body. The access token cookie is the fallback for browsers.
+type CredentialExtractor interface {
+	AccessToken(r *http.Request) (*Credential, error)
+}
+
+type CredentialExtractorImpl struct {
+	cookies TokenCookies
+}
+
+func NewCredentialExtractor(cookies TokenCookies) CredentialExtractor {
+	return &CredentialExtractorImpl{
+		cookies: cookies,
+	}
+}
+
+func (e *CredentialExtractorImpl) AccessToken(r *http.Request) (*Credential, error) {
+	var found []*Credential
+
+	if header := r.Header.Values("Authorization"); len(header) > 0 {
+		if len(header) > 1 {
+			return nil, ErrMalformedCredentials
+		}
+		credential, err := parseAuthorization(header[0])
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, credential)
+	}
+
+	if token, ok := formAccessToken(r); ok {
+		found = append(found, &Credential{Scheme: SchemeBearer, Token: token, Source: SourceForm})
+	}
+
+	if len(found) > 1 {
+		return nil, ErrMalformedCredentials
+	} else if len(found) == 1 {
+		return found[0], nil
+	}
+
+	// Browsers send cookies automatically, so they are only used when no explicit credential is present
+	token, err := e.cookies.AccessToken(r)
+	if errors.Is(err, ErrMissingCookie) {
+		return nil, ErrMissingToken
+	} else if err != nil {
+		return nil, err
+	}
+	return &Credential{Scheme: SchemeBearer, Token: token, Source: SourceCookie}, nil
+}
+
+// parseAuthorization parses an Authorization header value. Schemes are case-insensitive
+// and the credentials must be a single token68 value.
+func parseAuthorization(header string) (*Credential, error) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		if isSupportedScheme(scheme) {
+			return nil, ErrMalformedCredentials
+		}
+		return nil, ErrUnsupportedScheme
+	}
+
+	switch {
+	case strings.EqualFold(scheme, SchemeBearer):
+		scheme = SchemeBearer
+	case strings.EqualFold(scheme, SchemeDPoP):
+		scheme = SchemeDPoP
+	default:
+		return nil, ErrUnsupportedScheme
+	}
+
+	token = strings.TrimLeft(token, " ")
+	if !isToken68(token) {
+		return nil, ErrMalformedCredentials
+	}
+	return &Credential{Scheme: scheme, Token: token, Source: SourceHeader}, nil
+}
+
+func isSupportedScheme(scheme string) bool {
+	return strings.EqualFold(scheme, SchemeBearer) || strings.EqualFold(scheme, SchemeDPoP)
+}
+
+func isToken68(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	padding := false
+	for _, c := range value {
+		switch {
+		case c == '=':
+			padding = true
+		case padding:
+			return false
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '+', c == '/':
+		default:
+			return false
+		}
+	}
+	return value[0] != '='
+}
+
+// formAccessToken reads the access_token parameter of a form-encoded POST body (RFC 6750, section 2.2).
+func formAccessToken(r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return "", false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return "", false
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return "", false
+	}
+	token := r.PostForm.Get("access_token")
+	return token, token != ""
+}
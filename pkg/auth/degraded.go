@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/breaker"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/spf13/viper"
+)
+
+// DegradedHeader marks responses accepting a token that was not checked in Redis.
+const DegradedHeader = "X-Auth-Degraded"
+
+// Authentication is the outcome of a successful Authenticate.
+type Authentication struct {
+	*authjwt.JWTClaims
+	// Degraded is set when the token was accepted without checking Redis by the degraded policy.
+	Degraded bool
+}
+
+// degradedPolicy decides whether access tokens are accepted while the circuit breaker of the
+// cache is open. Such tokens cannot be checked for revocation in Redis, so only the signature,
+// the expiration, an optional maximum age and the local denylist are checked.
+type degradedPolicy struct {
+	enabled     bool
+	maxTokenAge time.Duration // zero for no limit
+	denylist    *denylist
+}
+
+func newDegradedPolicy() *degradedPolicy {
+	return &degradedPolicy{
+		enabled:     viper.GetBool("auth.degraded.enabled"),
+		maxTokenAge: viper.GetDuration("auth.degraded.max_token_age"),
+		denylist:    newDenylist(),
+	}
+}
+
+// accept returns nil when claims may be accepted despite err, the failure of the revocation
+// check, or the error to fail with otherwise.
+func (p *degradedPolicy) accept(ctx context.Context, claims *authjwt.JWTClaims, err error) error {
+	if !p.enabled || !errors.Is(err, breaker.ErrOpen) {
+		return err
+	}
+
+	if p.denylist.Contains(claims.UID) {
+		metrics.DegradedDecisions.WithLabelValues(metrics.DegradedRevoked).Inc()
+		return errors.Join(ErrInvalidToken, ErrTokenRevoked)
+	}
+	if p.maxTokenAge > 0 && (claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > p.maxTokenAge) {
+		metrics.DegradedDecisions.WithLabelValues(metrics.DegradedTooOld).Inc()
+		return err
+	}
+
+	metrics.DegradedDecisions.WithLabelValues(metrics.DegradedAccepted).Inc()
+	slog.WarnContext(ctx, "Accepted access token without checking revocation", "sub", claims.Subject, "uid", claims.UID)
+	return nil
+}
+
+// Deny adds a token revoked by this instance to the denylist, which is honored while Redis
+// is unavailable. Logouts on other instances are not known locally.
+func (p *degradedPolicy) Deny(claims *authjwt.JWTClaims) {
+	if p.enabled && claims.ExpiresAt != nil {
+		p.denylist.Add(claims.UID, claims.ExpiresAt.Time)
+	}
+}
+
+// denylist holds the UIDs of revoked tokens until they expire.
+type denylist struct {
+	mu        sync.Mutex
+	expiry    map[string]time.Time
+	lastPrune time.Time
+}
+
+func newDenylist() *denylist {
+	return &denylist{expiry: map[string]time.Time{}}
+}
+
+func (d *denylist) Add(uid string, expiresAt time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.expiry[uid] = expiresAt
+	if now.Sub(d.lastPrune) > time.Minute {
+		for id, expiry := range d.expiry {
+			if now.After(expiry) {
+				delete(d.expiry, id)
+			}
+		}
+		d.lastPrune = now
+	}
+}
+
+func (d *denylist) Contains(uid string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.expiry[uid]
+	return ok
+}
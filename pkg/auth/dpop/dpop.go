@@ -0,0 +1,245 @@
+package dpop
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+)
+
+// Proof errors are always joined with ErrInvalidProof, except for ErrUseNonce
+// which asks the client to retry with the nonce sent in the DPoP-Nonce header.
+var (
+	ErrInvalidProof  = errors.New("invalid DPoP proof")
+	ErrUseNonce      = errors.New("DPoP nonce required")
+	ErrProofReplayed = errors.New("DPoP proof replayed")
+)
+
+const (
+	Header      = "DPoP"
+	NonceHeader = "DPoP-Nonce"
+	proofType   = "dpop+jwt"
+)
+
+var defaultAlgorithms = []string{"ES256", "ES384", "ES512", "PS256", "PS384", "PS512", "RS256", "EdDSA"}
+
+// ReplayCache remembers the IDs of proofs that were already used.
+type ReplayCache interface {
+	// ClaimProof records a proof ID and reports whether it is used for the first time.
+	ClaimProof(ctx context.Context, t *tenant.Tenant, id string, ttl time.Duration) (bool, error)
+}
+
+// Request is the HTTP request a proof has to be bound to.
+type Request struct {
+	Method      string
+	URI         string
+	AccessToken string // hashed into the ath claim when the proof accompanies an access token
+}
+
+// Proof is a verified DPoP proof.
+type Proof struct {
+	ID            string
+	KeyThumbprint string // RFC 7638 thumbprint of the proof key, bound to tokens as cnf.jkt
+	IssuedAt      time.Time
+}
+
+type proofClaims struct {
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	ATH   string `json:"ath,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Verifier checks DPoP proofs (RFC 9449) and issues the nonces they have to carry.
+type Verifier interface {
+	Enabled() bool
+	Algorithms() []string
+	Verify(ctx context.Context, t *tenant.Tenant, proof string, req *Request) (*Proof, error)
+	Nonce(t *tenant.Tenant) string
+}
+
+type VerifierImpl struct {
+	replays       ReplayCache
+	enabled       bool
+	requireNonce  bool
+	algorithms    []string
+	maxAge        time.Duration
+	leeway        time.Duration
+	nonceLifetime time.Duration
+	now           func() time.Time
+}
+
+func NewVerifier(replays ReplayCache) Verifier {
+	algorithms := viper.GetStringSlice("auth.dpop.algorithms")
+	if len(algorithms) == 0 {
+		algorithms = defaultAlgorithms
+	}
+
+	return &VerifierImpl{
+		replays:       replays,
+		enabled:       viper.GetBool("auth.dpop.enabled"),
+		requireNonce:  !viper.IsSet("auth.dpop.require_nonce") || viper.GetBool("auth.dpop.require_nonce"),
+		algorithms:    algorithms,
+		maxAge:        config.DurationOrDefault("auth.dpop.proof_max_age", time.Minute),
+		leeway:        config.DurationOrDefault("auth.dpop.leeway", 5*time.Second),
+		nonceLifetime: config.DurationOrDefault("auth.dpop.nonce_lifetime", 5*time.Minute),
+		now:           time.Now,
+	}
+}
+
+func (v *VerifierImpl) Enabled() bool {
+	return v.enabled
+}
+
+func (v *VerifierImpl) Algorithms() []string {
+	return v.algorithms
+}
+
+func (v *VerifierImpl) Verify(ctx context.Context, t *tenant.Tenant, proof string, req *Request) (*Proof, error) {
+	var key *jwk
+	claims := &proofClaims{}
+	token, err := jwt.ParseWithClaims(proof, claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); !strings.EqualFold(typ, proofType) {
+			return nil, errors.New("unexpected proof type")
+		}
+		parsed, err := parseJWK(token.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		key = parsed
+		return key.PublicKey()
+	}, jwt.WithValidMethods(v.algorithms), jwt.WithLeeway(v.leeway))
+	if err != nil || !token.Valid {
+		return nil, errors.Join(ErrInvalidProof, err)
+	}
+
+	if claims.ID == "" || len(claims.ID) > 256 {
+		return nil, errors.Join(ErrInvalidProof, errors.New("missing or oversized jti"))
+	}
+	if claims.HTM != req.Method {
+		return nil, errors.Join(ErrInvalidProof, errors.New("htm does not match the request method"))
+	}
+	if !sameURI(claims.HTU, req.URI) {
+		return nil, errors.Join(ErrInvalidProof, errors.New("htu does not match the request URI"))
+	}
+	if err := v.checkIssuedAt(claims.IssuedAt); err != nil {
+		return nil, err
+	}
+	if req.AccessToken != "" && !hmac.Equal([]byte(claims.ATH), []byte(accessTokenHash(req.AccessToken))) {
+		return nil, errors.Join(ErrInvalidProof, errors.New("ath does not match the access token"))
+	}
+	if v.requireNonce && !v.validNonce(t, claims.Nonce) {
+		return nil, ErrUseNonce
+	}
+
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		return nil, errors.Join(ErrInvalidProof, err)
+	}
+
+	// Proofs outside the iat window are rejected above, so their IDs only have to be kept that long
+	fresh, err := v.replays.ClaimProof(ctx, t, thumbprint+":"+claims.ID, v.maxAge+2*v.leeway)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, errors.Join(ErrInvalidProof, ErrProofReplayed)
+	}
+
+	return &Proof{
+		ID:            claims.ID,
+		KeyThumbprint: thumbprint,
+		IssuedAt:      claims.IssuedAt.Time,
+	}, nil
+}
+
+func (v *VerifierImpl) checkIssuedAt(iat *jwt.NumericDate) error {
+	if iat == nil {
+		return errors.Join(ErrInvalidProof, errors.New("missing iat"))
+	}
+
+	now := v.now()
+	if iat.After(now.Add(v.leeway)) || iat.Before(now.Add(-v.maxAge-v.leeway)) {
+		return errors.Join(ErrInvalidProof, errors.New("iat is outside the acceptable window"))
+	}
+	return nil
+}
+
+// Nonce issues a nonce that is valid for the nonce lifetime. Nonces are authenticated with a key
+// derived from the tenant key, so that every instance of the service accepts them without shared state.
+func (v *VerifierImpl) Nonce(t *tenant.Tenant) string {
+	issued := make([]byte, 8)
+	binary.BigEndian.PutUint64(issued, uint64(v.now().Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(issued, nonceMAC(t, issued)...))
+}
+
+func (v *VerifierImpl) validNonce(t *tenant.Tenant, nonce string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) <= 8 {
+		return false
+	}
+
+	issued, mac := raw[:8], raw[8:]
+	if !hmac.Equal(mac, nonceMAC(t, issued)) {
+		return false
+	}
+
+	age := v.now().Sub(time.Unix(int64(binary.BigEndian.Uint64(issued)), 0))
+	return age >= -v.leeway && age <= v.nonceLifetime
+}
+
+func nonceMAC(t *tenant.Tenant, issued []byte) []byte {
+	keyMAC := hmac.New(sha256.New, t.Key)
+	keyMAC.Write([]byte("dpop-nonce"))
+
+	mac := hmac.New(sha256.New, keyMAC.Sum(nil))
+	mac.Write(issued)
+	return mac.Sum(nil)[:16]
+}
+
+func accessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// sameURI compares the htu claim with the request URI, ignoring query and fragment
+// and normalizing the scheme, host and default ports as required by RFC 9449, section 4.3.
+func sameURI(htu, uri string) bool {
+	a, errA := normalizeURI(htu)
+	b, errB := normalizeURI(uri)
+	return errA == nil && errB == nil && a == b
+}
+
+func normalizeURI(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return "", errors.New("not an absolute URI")
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		port = ""
+	}
+	if port != "" {
+		host += ":" + port
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return scheme + "://" + host + path, nil
+}
@@ -0,0 +1,211 @@
+package dpop
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryReplayCache struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (c *memoryReplayCache) ClaimProof(ctx context.Context, t *tenant.Tenant, id string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen[id] {
+		return false, nil
+	}
+	c.seen[id] = true
+	return true, nil
+}
+
+func newTestVerifier(requireNonce bool) *VerifierImpl {
+	return &VerifierImpl{
+		replays:       &memoryReplayCache{seen: map[string]bool{}},
+		enabled:       true,
+		requireNonce:  requireNonce,
+		algorithms:    defaultAlgorithms,
+		maxAge:        time.Minute,
+		leeway:        5 * time.Second,
+		nonceLifetime: 5 * time.Minute,
+		now:           time.Now,
+	}
+}
+
+type proofOptions struct {
+	htm, htu, ath, nonce string
+	iat                  time.Time
+	jti                  string
+}
+
+func signProof(t *testing.T, key *ecdsa.PrivateKey, opts proofOptions) string {
+	if opts.jti == "" {
+		opts.jti = uuid.New().String()
+	}
+	if opts.iat.IsZero() {
+		opts.iat = time.Now()
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, &proofClaims{
+		HTM:   opts.htm,
+		HTU:   opts.htu,
+		ATH:   opts.ath,
+		Nonce: opts.nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       opts.jti,
+			IssuedAt: jwt.NewNumericDate(opts.iat),
+		},
+	})
+	token.Header["typ"] = proofType
+	token.Header["jwk"] = map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestVerify(t *testing.T) {
+	tn := &tenant.Tenant{ID: tenant.DefaultID, Key: []byte("key")}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	verifier := newTestVerifier(false)
+
+	req := &Request{Method: "POST", URI: "https://auth.example.com/login"}
+	proof := signProof(t, key, proofOptions{htm: "POST", htu: "https://auth.example.com/login"})
+	verified, err := verifier.Verify(context.Background(), tn, proof, req)
+	require.NoError(t, err)
+	assert.Len(t, verified.KeyThumbprint, 43)
+
+	// Proofs are single-use
+	_, err = verifier.Verify(context.Background(), tn, proof, req)
+	assert.ErrorIs(t, err, ErrProofReplayed)
+	assert.ErrorIs(t, err, ErrInvalidProof)
+
+	// Query, fragment, default ports and case are ignored when comparing htu
+	proof = signProof(t, key, proofOptions{htm: "POST", htu: "HTTPS://Auth.Example.com:443/login"})
+	_, err = verifier.Verify(context.Background(), tn, proof, &Request{Method: "POST", URI: "https://auth.example.com/login?next=1"})
+	assert.NoError(t, err)
+
+	for name, opts := range map[string]proofOptions{
+		"wrong method": {htm: "GET", htu: "https://auth.example.com/login"},
+		"wrong uri":    {htm: "POST", htu: "https://auth.example.com/refresh"},
+		"stale":        {htm: "POST", htu: "https://auth.example.com/login", iat: time.Now().Add(-2 * time.Minute)},
+		"future":       {htm: "POST", htu: "https://auth.example.com/login", iat: time.Now().Add(time.Minute)},
+	} {
+		_, err := verifier.Verify(context.Background(), tn, signProof(t, key, opts), req)
+		assert.ErrorIs(t, err, ErrInvalidProof, name)
+	}
+
+	_, err = verifier.Verify(context.Background(), tn, "not-a-jwt", req)
+	assert.ErrorIs(t, err, ErrInvalidProof)
+}
+
+func TestVerifyAccessTokenHash(t *testing.T) {
+	tn := &tenant.Tenant{ID: tenant.DefaultID, Key: []byte("key")}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	verifier := newTestVerifier(false)
+
+	req := &Request{Method: "GET", URI: "https://api.example.com/orders", AccessToken: "access-token"}
+
+	_, err = verifier.Verify(context.Background(), tn, signProof(t, key, proofOptions{htm: "GET", htu: req.URI}), req)
+	assert.ErrorIs(t, err, ErrInvalidProof)
+
+	_, err = verifier.Verify(context.Background(), tn, signProof(t, key, proofOptions{htm: "GET", htu: req.URI, ath: accessTokenHash("other-token")}), req)
+	assert.ErrorIs(t, err, ErrInvalidProof)
+
+	_, err = verifier.Verify(context.Background(), tn, signProof(t, key, proofOptions{htm: "GET", htu: req.URI, ath: accessTokenHash("access-token")}), req)
+	assert.NoError(t, err)
+}
+
+func TestVerifyNonce(t *testing.T) {
+	tn := &tenant.Tenant{ID: tenant.DefaultID, Key: []byte("key")}
+	other := &tenant.Tenant{ID: "acme", Key: []byte("other-key")}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	verifier := newTestVerifier(true)
+	req := &Request{Method: "POST", URI: "https://auth.example.com/login"}
+
+	_, err = verifier.Verify(context.Background(), tn, signProof(t, key, proofOptions{htm: "POST", htu: req.URI}), req)
+	assert.ErrorIs(t, err, ErrUseNonce)
+
+	// Nonces of other tenants are not accepted
+	_, err = verifier.Verify(context.Background(), tn, signProof(t, key, proofOptions{htm: "POST", htu: req.URI, nonce: verifier.Nonce(other)}), req)
+	assert.ErrorIs(t, err, ErrUseNonce)
+
+	_, err = verifier.Verify(context.Background(), tn, signProof(t, key, proofOptions{htm: "POST", htu: req.URI, nonce: verifier.Nonce(tn)}), req)
+	assert.NoError(t, err)
+
+	// Expired nonces have to be replaced
+	verifier.now = func() time.Time { return time.Now().Add(-10 * time.Minute) }
+	expired := verifier.Nonce(tn)
+	verifier.now = time.Now
+	_, err = verifier.Verify(context.Background(), tn, signProof(t, key, proofOptions{htm: "POST", htu: req.URI, nonce: expired}), req)
+	assert.ErrorIs(t, err, ErrUseNonce)
+}
+
+func TestVerifyRejectsUnsafeHeaders(t *testing.T) {
+	tn := &tenant.Tenant{ID: tenant.DefaultID, Key: []byte("key")}
+	verifier := newTestVerifier(false)
+	req := &Request{Method: "POST", URI: "https://auth.example.com/login"}
+	claims := &proofClaims{HTM: "POST", HTU: req.URI, RegisteredClaims: jwt.RegisteredClaims{ID: "1", IssuedAt: jwt.NewNumericDate(time.Now())}}
+
+	// Symmetric algorithms cannot prove possession of a public key
+	symmetric := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	symmetric.Header["typ"] = proofType
+	signed, err := symmetric.SignedString([]byte("secret"))
+	require.NoError(t, err)
+	_, err = verifier.Verify(context.Background(), tn, signed, req)
+	assert.ErrorIs(t, err, ErrInvalidProof)
+
+	// Proofs must be typed and must not leak the private key
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	for name, header := range map[string]map[string]any{
+		"untyped":     {"typ": "JWT"},
+		"private key": {"jwk": map[string]string{"kty": "EC", "crv": "P-256", "d": "secret"}},
+	} {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["typ"] = proofType
+		for k, v := range header {
+			token.Header[k] = v
+		}
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		_, err = verifier.Verify(context.Background(), tn, signed, req)
+		assert.ErrorIs(t, err, ErrInvalidProof, name)
+	}
+}
+
+// Example from RFC 7638, section 3.1
+func TestThumbprint(t *testing.T) {
+	key := &jwk{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+	thumbprint, err := key.Thumbprint()
+	require.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+
+	_, err = key.PublicKey()
+	assert.NoError(t, err)
+}
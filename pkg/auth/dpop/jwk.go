@@ -0,0 +1,132 @@
+package dpop
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+var ErrInvalidKey = errors.New("invalid proof key")
+
+// jwk is the public key embedded in the header of a DPoP proof (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	D   string `json:"d,omitempty"`
+}
+
+func parseJWK(raw any) (*jwk, error) {
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	var key jwk
+	if err := json.Unmarshal(encoded, &key); err != nil {
+		return nil, ErrInvalidKey
+	}
+	// A proof carrying a private key is a client bug that leaked its key
+	if key.D != "" {
+		return nil, errors.Join(ErrInvalidKey, errors.New("private key in proof header"))
+	}
+	return &key, nil
+}
+
+// PublicKey converts the JWK to a key usable for signature verification.
+func (k *jwk) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, ErrInvalidKey
+		}
+
+		x, errX := decodeInt(k.X)
+		y, errY := decodeInt(k.Y)
+		if errX != nil || errY != nil {
+			return nil, ErrInvalidKey
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if !curve.IsOnCurve(x, y) {
+			return nil, ErrInvalidKey
+		}
+		return key, nil
+	case "RSA":
+		n, errN := decodeInt(k.N)
+		e, errE := decodeInt(k.E)
+		if errN != nil || errE != nil || !e.IsInt64() || n.BitLen() < 2048 {
+			return nil, ErrInvalidKey
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, ErrInvalidKey
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, ErrInvalidKey
+	}
+}
+
+// Thumbprint computes the RFC 7638 JWK thumbprint: the base64url SHA-256 hash of the
+// required members of the key, serialized in lexicographic order without whitespace.
+func (k *jwk) Thumbprint() (string, error) {
+	var members any
+	switch k.Kty {
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y}
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	default:
+		return "", ErrInvalidKey
+	}
+
+	encoded, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(raw) == 0 {
+		return nil, ErrInvalidKey
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/dpop"
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+)
+
+var (
+	// ErrInvalidToken is shared with authjwt so that a single check covers every token error.
+	ErrInvalidToken     = authjwt.ErrInvalidToken
+	ErrInvalidTokenType = errors.New("invalid token type")
+	ErrTokenRevoked     = errors.New("token revoked")
+	ErrMissingToken     = errors.New("missing token")
+	ErrCacheUnavailable = errors.New("cache unavailable")
+)
+
+// Reason classifies why an auth operation failed. Reasons are part of the public API:
+// they are returned as problem codes, gRPC error reasons and metric labels,
+// and must not change once released.
+type Reason string
+
+const (
+	ReasonNone                 Reason = ""
+	ReasonInvalidRequest       Reason = problem.CodeInvalidRequest
+	ReasonMissingToken         Reason = "missing_token"
+	ReasonUnsupportedScheme    Reason = "unsupported_scheme"
+	ReasonMalformedCredentials Reason = "malformed_credentials"
+	ReasonInvalidToken         Reason = "invalid_token"
+	ReasonTokenMalformed       Reason = "token_malformed"
+	ReasonSignatureInvalid     Reason = "invalid_signature"
+	ReasonTokenExpired         Reason = "token_expired"
+	ReasonTokenNotYetValid     Reason = "token_not_yet_valid"
+	ReasonIssuerInvalid        Reason = "invalid_issuer"
+	ReasonTokenRevoked         Reason = "token_revoked"
+	ReasonInvalidTokenType     Reason = "invalid_token_type"
+	ReasonTokenBindingMismatch Reason = "token_binding_mismatch"
+	ReasonInvalidDPoPProof     Reason = "invalid_dpop_proof"
+	ReasonUseDPoPNonce         Reason = "use_dpop_nonce"
+	ReasonStepUpRequired       Reason = "insufficient_user_authentication"
+	ReasonExchangeNotPermitted Reason = "exchange_not_permitted"
+	ReasonInvalidScope         Reason = "invalid_scope"
+	ReasonInvalidCSRFToken     Reason = "invalid_csrf_token"
+	ReasonUnknownTenant        Reason = "unknown_tenant"
+	ReasonCacheUnavailable     Reason = "cache_unavailable"
+	ReasonInternalError        Reason = problem.CodeInternalError
+)
+
+// ReasonOf classifies an error returned by the auth and authjwt packages.
+// More specific errors are checked first since token errors are joined with ErrInvalidToken.
+func ReasonOf(err error) Reason {
+	switch {
+	case err == nil:
+		return ReasonNone
+	case errors.Is(err, ErrCacheUnavailable):
+		return ReasonCacheUnavailable
+	case errors.Is(err, dpop.ErrUseNonce):
+		return ReasonUseDPoPNonce
+	case errors.Is(err, dpop.ErrInvalidProof):
+		return ReasonInvalidDPoPProof
+	case errors.Is(err, authjwt.ErrTokenExpired):
+		return ReasonTokenExpired
+	case errors.Is(err, authjwt.ErrTokenNotYetValid):
+		return ReasonTokenNotYetValid
+	case errors.Is(err, authjwt.ErrTokenMalformed):
+		return ReasonTokenMalformed
+	case errors.Is(err, authjwt.ErrTokenSignatureInvalid):
+		return ReasonSignatureInvalid
+	case errors.Is(err, authjwt.ErrTokenIssuerInvalid):
+		return ReasonIssuerInvalid
+	case errors.Is(err, ErrTokenRevoked):
+		return ReasonTokenRevoked
+	case errors.Is(err, ErrInvalidTokenType):
+		return ReasonInvalidTokenType
+	case errors.Is(err, ErrTokenBindingMismatch):
+		return ReasonTokenBindingMismatch
+	case errors.Is(err, ErrStepUpRequired):
+		return ReasonStepUpRequired
+	case errors.Is(err, ErrInvalidToken):
+		return ReasonInvalidToken
+	case errors.Is(err, ErrMissingToken), errors.Is(err, ErrMissingCookie):
+		return ReasonMissingToken
+	case errors.Is(err, ErrUnsupportedScheme):
+		return ReasonUnsupportedScheme
+	case errors.Is(err, ErrMalformedCredentials):
+		return ReasonMalformedCredentials
+	case errors.Is(err, ErrInvalidCSRFToken):
+		return ReasonInvalidCSRFToken
+	case errors.Is(err, ErrExchangeNotPermitted):
+		return ReasonExchangeNotPermitted
+	case errors.Is(err, ErrInvalidScope):
+		return ReasonInvalidScope
+	case errors.Is(err, authjwt.ErrInvalidSubject), errors.Is(err, ErrInvalidAuthTime):
+		return ReasonInvalidRequest
+	case errors.Is(err, tenant.ErrUnknownTenant):
+		return ReasonUnknownTenant
+	default:
+		return ReasonInternalError
+	}
+}
+
+var reasonProblems = map[Reason]struct {
+	status int
+	detail string
+}{
+	ReasonInvalidRequest:       {http.StatusBadRequest, "subject is missing or invalid"},
+	ReasonMissingToken:         {http.StatusUnauthorized, "request carries no token"},
+	ReasonUnsupportedScheme:    {http.StatusUnauthorized, "authorization scheme is not supported"},
+	ReasonMalformedCredentials: {http.StatusBadRequest, "credentials are malformed or presented more than once"},
+	ReasonInvalidToken:         {http.StatusUnauthorized, "token is invalid"},
+	ReasonTokenMalformed:       {http.StatusUnauthorized, "token is malformed"},
+	ReasonSignatureInvalid:     {http.StatusUnauthorized, "token signature is invalid"},
+	ReasonTokenExpired:         {http.StatusUnauthorized, "token has expired"},
+	ReasonTokenNotYetValid:     {http.StatusUnauthorized, "token is not valid yet"},
+	ReasonIssuerInvalid:        {http.StatusUnauthorized, "token was issued for another tenant"},
+	ReasonTokenRevoked:         {http.StatusUnauthorized, "token has been revoked"},
+	ReasonInvalidTokenType:     {http.StatusUnauthorized, "token has the wrong type"},
+	ReasonTokenBindingMismatch: {http.StatusUnauthorized, "token is bound to a key the sender did not prove"},
+	ReasonInvalidDPoPProof:     {http.StatusUnauthorized, "DPoP proof is missing or invalid"},
+	ReasonUseDPoPNonce:         {http.StatusUnauthorized, "DPoP proof must carry the nonce sent in the DPoP-Nonce header"},
+	ReasonStepUpRequired:       {http.StatusUnauthorized, "a more recent or stronger authentication is required"},
+	ReasonInvalidCSRFToken:     {http.StatusForbidden, "CSRF token is missing or does not match"},
+	ReasonExchangeNotPermitted: {http.StatusForbidden, "no policy allows the actor to exchange this token"},
+	ReasonInvalidScope:         {http.StatusBadRequest, "requested scope exceeds the scope available to the exchange"},
+	ReasonUnknownTenant:        {http.StatusNotFound, "tenant is not known"},
+	ReasonCacheUnavailable:     {http.StatusServiceUnavailable, "session storage is unavailable"},
+	ReasonInternalError:        {http.StatusInternalServerError, "internal server error"},
+}
+
+func problemFromError(err error) *problem.Problem {
+	reason := ReasonOf(err)
+	p, ok := reasonProblems[reason]
+	if !ok {
+		reason, p = ReasonInternalError, reasonProblems[ReasonInternalError]
+	}
+	return problem.New(p.status, string(reason), p.detail)
+}
+
+// challenge builds an RFC 6750 WWW-Authenticate challenge for a failed request.
+// Requests without usable credentials get a bare challenge without an error code.
+func challenge(scheme, realm string, reason Reason, p *problem.Problem) string {
+	value := fmt.Sprintf("%s realm=%q", scheme, realm)
+	switch {
+	case reason == ReasonMissingToken, reason == ReasonUnsupportedScheme:
+		return value
+	case reason == ReasonInvalidDPoPProof, reason == ReasonUseDPoPNonce, reason == ReasonStepUpRequired:
+		return value + fmt.Sprintf(", error=%q, error_description=%q", string(reason), p.Detail)
+	case p.Status == http.StatusBadRequest:
+		return value + fmt.Sprintf(", error=\"invalid_request\", error_description=%q", p.Detail)
+	default:
+		return value + fmt.Sprintf(", error=\"invalid_token\", error_description=%q", p.Detail)
+	}
+}
@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/audit"
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tracing"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrExchangeNotPermitted = errors.New("token exchange not permitted")
+	ErrInvalidScope         = errors.New("invalid scope")
+)
+
+// Token type identifiers of RFC 8693, section 3.
+const (
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// ExchangePolicy allows an actor to exchange tokens of some subjects for tokens limited to some scopes.
+// "*" matches any actor, subject or scope.
+type ExchangePolicy struct {
+	Actor    string   `mapstructure:"actor"`
+	Subjects []string `mapstructure:"subjects"`
+	Scopes   []string `mapstructure:"scopes"`
+	// Impersonate allows the actor to obtain tokens for subjects without presenting their token.
+	Impersonate bool `mapstructure:"impersonate"`
+}
+
+func (p *ExchangePolicy) allows(actor, subject string, impersonation bool) bool {
+	if impersonation && !p.Impersonate {
+		return false
+	}
+	return matches([]string{p.Actor}, actor) && matches(p.Subjects, subject)
+}
+
+// ExchangeRequest asks for a token for the subject of SubjectToken, or for RequestedSubject
+// when an actor impersonates a subject. With an actor token the issued token is delegated to the actor.
+type ExchangeRequest struct {
+	SubjectToken     string
+	RequestedSubject string
+	ActorToken       string
+	Scope            string // space-delimited, defaults to every scope the exchange allows
+	Sender           *Sender
+	Confirmation     *authjwt.Confirmation
+}
+
+type ExchangeResult struct {
+	AccessToken string
+	Scope       string
+	ExpiresIn   time.Duration
+}
+
+type exchangeConfig struct {
+	lifetime time.Duration
+	maxDepth int
+	policies []ExchangePolicy
+}
+
+func newExchangeConfig() exchangeConfig {
+	config := exchangeConfig{
+		lifetime: viper.GetDuration("token_exchange.lifetime"),
+		maxDepth: viper.GetInt("token_exchange.max_delegation_depth"),
+	}
+	if config.lifetime <= 0 {
+		config.lifetime = 5 * time.Minute
+	}
+	if config.maxDepth <= 0 {
+		config.maxDepth = 3
+	}
+	if err := viper.UnmarshalKey("token_exchange.policies", &config.policies); err != nil {
+		slog.Error("Failed to parse token exchange policies, denying delegated exchanges", slog.Any("error", err))
+		config.policies = nil
+	}
+	return config
+}
+
+func (s *AuthServiceImpl) Exchange(ctx context.Context, t *tenant.Tenant, req *ExchangeRequest) (result *ExchangeResult, err error) {
+	ctx, span := startSpan(ctx, "AuthService.Exchange", t)
+	defer func() { tracing.End(span, err) }()
+
+	event := audit.Event{Type: audit.TypeExchange}
+	defer func() { record(ctx, t, event, err) }()
+
+	return s.exchange(ctx, t, req, &event)
+}
+
+// exchange performs the exchange, filling event with what is known at the point it succeeded or failed.
+func (s *AuthServiceImpl) exchange(ctx context.Context, t *tenant.Tenant, req *ExchangeRequest, event *audit.Event) (*ExchangeResult, error) {
+	var actor *authjwt.JWTClaims
+	if req.ActorToken != "" {
+		claims, err := s.validateAccessToken(ctx, t, req.ActorToken)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyConfirmation(claims, req.Sender); err != nil {
+			return nil, err
+		}
+		actor = claims
+		event.Actor, event.Session = actor.Subject, actor.UID
+	}
+
+	// Without a subject token the actor impersonates the requested subject
+	impersonation := req.SubjectToken == ""
+	if impersonation {
+		event.Type = audit.TypeImpersonation
+	}
+	var subject *authjwt.JWTClaims
+	if impersonation {
+		if actor == nil || req.RequestedSubject == "" {
+			return nil, errors.Join(ErrMissingToken, errors.New("subject token is required"))
+		}
+		subject = &authjwt.JWTClaims{}
+		subject.Subject = req.RequestedSubject
+	} else {
+		claims, err := s.validateAccessToken(ctx, t, req.SubjectToken)
+		if err != nil {
+			return nil, err
+		}
+		// Delegated exchanges are authorized by the actor, so only self-service exchanges need the subject's key
+		if actor == nil {
+			if err := verifyConfirmation(claims, req.Sender); err != nil {
+				return nil, err
+			}
+		}
+		subject = claims
+		event.Session = subject.UID
+	}
+	event.Subject = subject.Subject
+
+	grant := &authjwt.Grant{Subject: subject.Subject, Confirmation: req.Confirmation}
+	if !impersonation {
+		// The exchanged token vouches for the same authentication as the subject token
+		authn := authjwt.GrantFromClaims(subject)
+		grant.AuthTime, grant.ACR, grant.AMR = authn.AuthTime, authn.ACR, authn.AMR
+	}
+	available := strings.Fields(subject.Scope)
+	if actor != nil {
+		policy := s.exchangePolicy(actor.Subject, subject.Subject, impersonation)
+		if policy == nil {
+			return nil, ErrExchangeNotPermitted
+		}
+
+		grant.Actor = &authjwt.Actor{Subject: actor.Subject, Actor: subject.Actor}
+		if grant.Actor.Depth() > s.exchangeConfig.maxDepth {
+			return nil, errors.Join(ErrExchangeNotPermitted, errors.New("delegation chain is too long"))
+		}
+
+		if impersonation {
+			available = policy.Scopes
+		} else if !slices.Contains(policy.Scopes, "*") {
+			available = slices.DeleteFunc(available, func(scope string) bool {
+				return !slices.Contains(policy.Scopes, scope)
+			})
+		}
+	} else {
+		// Narrowing one's own token keeps its delegation chain
+		grant.Actor = subject.Actor
+	}
+
+	// Unrestricted policies default to the scope of the presented token. Impersonation presents
+	// no subject token, so the token of the actor stands in for it.
+	presented := subject.Scope
+	if impersonation {
+		presented = actor.Scope
+	}
+	scope, err := narrowScope(req.Scope, available, presented)
+	if err != nil {
+		return nil, err
+	}
+	grant.Scope = scope
+	event.Scope = scope
+
+	// Exchanged tokens never outlive the tokens they were exchanged for
+	lifetime := min(s.exchangeConfig.lifetime, t.AccessLifetime)
+	if !impersonation && subject.ExpiresAt != nil {
+		lifetime = min(lifetime, time.Until(subject.ExpiresAt.Time))
+	}
+	if actor != nil && actor.ExpiresAt != nil {
+		lifetime = min(lifetime, time.Until(actor.ExpiresAt.Time))
+	}
+
+	token, err := s.jwtService.NewExchangedToken(ctx, t, grant, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.CacheExchangedToken(ctx, t, token); err != nil {
+		return nil, errors.Join(errors.New("failed to cache exchanged token"), err)
+	}
+
+	return &ExchangeResult{AccessToken: token, Scope: scope, ExpiresIn: lifetime}, nil
+}
+
+func (s *AuthServiceImpl) exchangePolicy(actor, subject string, impersonation bool) *ExchangePolicy {
+	for i := range s.exchangeConfig.policies {
+		if s.exchangeConfig.policies[i].allows(actor, subject, impersonation) {
+			return &s.exchangeConfig.policies[i]
+		}
+	}
+	return nil
+}
+
+// narrowScope checks that every requested scope is available. Without a requested scope
+// the issued token gets all available scopes, or the scope of the presented token when
+// any scope is available.
+func narrowScope(requested string, available []string, presented string) (string, error) {
+	if requested == "" {
+		if slices.Contains(available, "*") {
+			return presented, nil
+		}
+		return strings.Join(available, " "), nil
+	}
+
+	scopes := strings.Fields(requested)
+	for _, scope := range scopes {
+		if !matches(available, scope) {
+			return "", errors.Join(ErrInvalidScope, errors.New("scope exceeds the scope of the exchanged token: "+scope))
+		}
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+func matches(patterns []string, value string) bool {
+	return slices.Contains(patterns, "*") || slices.Contains(patterns, value)
+}
+
+// TokenExchange implements the token exchange grant of RFC 8693. Like other OAuth token
+// requests, the parameters are sent form-encoded in the request body.
+func (h *AuthHandlerImpl) TokenExchange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		slog.WarnContext(r.Context(), "Invalid method for token exchange", "method", r.Method, "path", r.URL.Path)
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+
+	if !h.exchangeEnabled {
+		problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "token exchange is not enabled")
+		return
+	}
+
+	t, ok := h.resolveTenant(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		slog.WarnContext(r.Context(), "Failed to parse token exchange request", "error", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	form := r.PostForm
+	if form.Get("grant_type") != GrantTypeTokenExchange {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "grant_type must be "+GrantTypeTokenExchange)
+		return
+	}
+	for _, param := range []string{"subject_token", "actor_token"} {
+		if form.Get(param) != "" && !isSupportedTokenType(form.Get(param+"_type")) {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, param+"_type is not supported")
+			return
+		}
+	}
+	if requested := form.Get("requested_token_type"); requested != "" && requested != TokenTypeAccessToken {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "only access tokens can be requested")
+		return
+	}
+
+	sender, err := h.sender(w, r, t, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Token exchange request carries an invalid proof", "error", err, "reason", ReasonOf(err))
+		recordEvent(r.Context(), audit.TypeExchange, t, "", "", err)
+		h.writeError(w, r, err)
+		return
+	}
+
+	confirmation := confirmationFor(sender, h.bindToCert)
+	result, err := h.service.Exchange(r.Context(), t, &ExchangeRequest{
+		SubjectToken:     form.Get("subject_token"),
+		RequestedSubject: form.Get("requested_subject"),
+		ActorToken:       form.Get("actor_token"),
+		Scope:            form.Get("scope"),
+		Sender:           sender,
+		Confirmation:     confirmation,
+	})
+	if err != nil {
+		slog.WarnContext(r.Context(), "Token exchange failed", "error", err, "reason", ReasonOf(err))
+		h.writeError(w, r, err)
+		return
+	}
+
+	type exchangeResponse struct {
+		AccessToken     string `json:"access_token"`
+		IssuedTokenType string `json:"issued_token_type"`
+		TokenType       string `json:"token_type"`
+		ExpiresIn       int    `json:"expires_in"`
+		Scope           string `json:"scope,omitempty"`
+	}
+
+	tokenType := SchemeBearer
+	if confirmation != nil && confirmation.JKT != "" {
+		tokenType = SchemeDPoP
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(exchangeResponse{
+		AccessToken:     result.AccessToken,
+		IssuedTokenType: TokenTypeAccessToken,
+		TokenType:       tokenType,
+		ExpiresIn:       int(result.ExpiresIn.Seconds()),
+		Scope:           result.Scope,
+	}); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode token exchange response", "error", err)
+	}
+}
+
+func isSupportedTokenType(tokenType string) bool {
+	return tokenType == TokenTypeAccessToken || tokenType == TokenTypeJWT
+}
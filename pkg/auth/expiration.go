@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tracing"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// expirationWriter slides the expiration of sessions in the background. Extensions of the same
+// session within a flush interval are coalesced into a single EXPIRE, and every flush sends the
+// pending extensions in pipelined batches. When the queue is full new sessions are dropped:
+// a dropped session is extended again on its next request.
+type expirationWriter struct {
+	cache      *redis.Client
+	interval   time.Duration
+	timeout    time.Duration
+	batchSize  int
+	maxPending int
+
+	mu      sync.Mutex
+	pending map[string]time.Duration // TTL by session key
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newExpirationWriter(cache *redis.Client) *expirationWriter {
+	w := &expirationWriter{
+		cache:      cache,
+		interval:   config.DurationOrDefault("cache.background.flush_interval", time.Second),
+		timeout:    config.DurationOrDefault("cache.background.timeout", time.Second),
+		batchSize:  config.IntOrDefault("cache.background.batch_size", 500),
+		maxPending: config.IntOrDefault("cache.background.max_pending", 10000),
+		pending:    map[string]time.Duration{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Extend queues an extension of the session stored at key. It never blocks on Redis.
+func (w *expirationWriter) Extend(key string, ttl time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.pending[key]; ok {
+		w.pending[key] = ttl
+		metrics.SessionExtensions.WithLabelValues(metrics.ExtensionCoalesced).Inc()
+		return
+	}
+	if len(w.pending) >= w.maxPending {
+		metrics.SessionExtensions.WithLabelValues(metrics.ExtensionDropped).Inc()
+		return
+	}
+	w.pending[key] = ttl
+	metrics.SessionExtensionQueue.Set(float64(len(w.pending)))
+}
+
+func (w *expirationWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.flush()
+		case <-w.stop:
+			w.flush()
+			return
+		}
+	}
+}
+
+func (w *expirationWriter) flush() {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]time.Duration, len(pending))
+	metrics.SessionExtensionQueue.Set(0)
+	w.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, span := tracer.Start(context.Background(), "AuthRepo.FlushSessionExtensions")
+	span.SetAttributes(attribute.Int("sessions", len(pending)))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	for start := 0; start < len(keys); start += w.batchSize {
+		batch := keys[start:min(start+w.batchSize, len(keys))]
+		if batchErr := w.write(ctx, batch, pending); batchErr != nil {
+			err = batchErr
+			metrics.SessionExtensions.WithLabelValues(metrics.ExtensionFailed).Add(float64(len(batch)))
+			slog.Warn("Failed to extend session expiration", slog.Int("sessions", len(batch)), slog.Any("error", batchErr))
+			continue
+		}
+		metrics.SessionExtensions.WithLabelValues(metrics.ExtensionWritten).Add(float64(len(batch)))
+	}
+}
+
+func (w *expirationWriter) write(ctx context.Context, keys []string, ttls map[string]time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	_, err := w.cache.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Expire(ctx, key, ttls[key])
+		}
+		return nil
+	})
+	return err
+}
+
+// Close writes the pending extensions and stops the writer, waiting until ctx is done at most.
+func (w *expirationWriter) Close(ctx context.Context) error {
+	w.once.Do(func() { close(w.stop) })
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
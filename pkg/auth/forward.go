@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/audit"
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+)
+
+// forwardAuthHeaders names the response headers that carry the identity
+// of an authenticated request back to the proxy.
+type forwardAuthHeaders struct {
+	subject string
+	scopes  string
+	tenant  string
+	actor   string
+}
+
+func newForwardAuthHeaders() forwardAuthHeaders {
+	return forwardAuthHeaders{
+		subject: config.StringOrDefault("forward_auth.headers.subject", "X-User-Id"),
+		scopes:  config.StringOrDefault("forward_auth.headers.scopes", "X-Scopes"),
+		tenant:  config.StringOrDefault("forward_auth.headers.tenant", "X-Tenant-Id"),
+		actor:   config.StringOrDefault("forward_auth.headers.actor", "X-Actor-Id"),
+	}
+}
+
+// ForwardAuth answers authorization subrequests of reverse proxies such as
+// NGINX auth_request, Traefik forwardAuth and Envoy ext_authz (HTTP service).
+// Any method is accepted since proxies forward the method of the original request.
+func (h *AuthHandlerImpl) ForwardAuth(w http.ResponseWriter, r *http.Request) {
+	t, ok := h.resolveTenant(w, r)
+	if !ok {
+		return
+	}
+
+	requirement, err := parseAuthnRequirement(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid authentication requirement", "error", err)
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	credential, err := h.forwardedCredential(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Forward auth request rejected", "error", err)
+		recordEvent(r.Context(), audit.TypeAuthentication, t, "", "", err)
+		h.writeError(w, r, err)
+		return
+	}
+
+	sender, err := h.sender(w, r, t, credential)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Forward auth request carries an invalid proof", "error", err, "reason", ReasonOf(err))
+		recordEvent(r.Context(), audit.TypeAuthentication, t, "", "", err)
+		h.writeError(w, r, err)
+		return
+	}
+
+	authn, err := h.service.Authenticate(r.Context(), t, credential.Token, sender, requirement)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Forward authentication failed", "error", err, "reason", ReasonOf(err))
+		h.writeError(w, r, err)
+		return
+	}
+	claims := authn.JWTClaims
+	slog.DebugContext(r.Context(), "Forward authentication successful", "tenant", t.ID, "sub", claims.Subject)
+
+	w.Header().Set(h.forwardHeaders.subject, claims.Subject)
+	w.Header().Set(h.forwardHeaders.scopes, claims.Scope)
+	w.Header().Set(h.forwardHeaders.tenant, t.ID)
+	if claims.Actor != nil {
+		w.Header().Set(h.forwardHeaders.actor, claims.Actor.Subject)
+	}
+	if authn.Degraded {
+		w.Header().Set(DegradedHeader, "true")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// forwardedCredential reads the access token of the original request.
+// Cookie credentials are checked for CSRF against the original method reported by a trusted proxy.
+func (h *AuthHandlerImpl) forwardedCredential(r *http.Request) (*Credential, error) {
+	original := r.Clone(r.Context())
+	original.Method = originalMethod(r, h.forwarded(r))
+	return h.credentials.AccessToken(original)
+}
@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/GregoryKogan/jwt-microservice/pkg/mtls"
+	authv1 "github.com/GregoryKogan/jwt-microservice/pkg/pb/auth/v1"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const grpcErrorDomain = "jwt-microservice"
+
+// AuthGRPCServer exposes AuthService over gRPC.
+type AuthGRPCServer struct {
+	authv1.UnimplementedAuthServiceServer
+	service    AuthService
+	tenants    tenant.Registry
+	bindToCert bool
+}
+
+func NewAuthGRPCServer(service AuthService, tenants tenant.Registry) authv1.AuthServiceServer {
+	return &AuthGRPCServer{
+		service:    service,
+		tenants:    tenants,
+		bindToCert: viper.GetBool("auth.certificate_binding"),
+	}
+}
+
+func (s *AuthGRPCServer) Login(ctx context.Context, req *authv1.LoginRequest) (*authv1.LoginResponse, error) {
+	t, err := s.resolveTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetSub() == "" {
+		return nil, grpcError(authjwt.ErrInvalidSubject, "missing subject")
+	}
+
+	var authTime time.Time
+	if req.GetAuthTime() != nil {
+		authTime = req.GetAuthTime().AsTime()
+	}
+	if err := checkAuthTime(authTime); err != nil {
+		return nil, grpcError(err, err.Error())
+	}
+
+	grant := &authjwt.Grant{
+		Subject:      req.GetSub(),
+		Scope:        req.GetScope(),
+		Confirmation: confirmationFor(grpcSender(ctx), s.bindToCert),
+		AuthTime:     authTime,
+		ACR:          req.GetAcr(),
+		AMR:          req.GetAmr(),
+	}
+
+	tokenPair, err := s.service.Login(ctx, t, grant)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to login user over gRPC", "error", err, "reason", ReasonOf(err), "sub", req.GetSub())
+		return nil, grpcError(err, "failed to login")
+	}
+
+	return &authv1.LoginResponse{Access: tokenPair.Access, Refresh: tokenPair.Refresh}, nil
+}
+
+func (s *AuthGRPCServer) Refresh(ctx context.Context, req *authv1.RefreshRequest) (*authv1.RefreshResponse, error) {
+	t, err := s.resolveTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenPair, err := s.service.Refresh(ctx, t, req.GetRefresh(), grpcSender(ctx))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to refresh token over gRPC", "error", err, "reason", ReasonOf(err))
+		return nil, grpcError(err, "failed to refresh token")
+	}
+
+	return &authv1.RefreshResponse{Access: tokenPair.Access, Refresh: tokenPair.Refresh}, nil
+}
+
+func (s *AuthGRPCServer) Logout(ctx context.Context, req *authv1.LogoutRequest) (*authv1.LogoutResponse, error) {
+	t, err := s.resolveTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.service.Logout(ctx, t, req.GetAccess(), grpcSender(ctx)); err != nil {
+		slog.ErrorContext(ctx, "Failed to logout over gRPC", "error", err, "reason", ReasonOf(err))
+		return nil, grpcError(err, "failed to logout")
+	}
+
+	return &authv1.LogoutResponse{}, nil
+}
+
+func (s *AuthGRPCServer) Authenticate(ctx context.Context, req *authv1.AuthenticateRequest) (*authv1.AuthenticateResponse, error) {
+	t, err := s.resolveTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	authn, err := s.service.Authenticate(ctx, t, req.GetAccess(), grpcSender(ctx), authnRequirementFromProto(req))
+	if err != nil {
+		slog.DebugContext(ctx, "Authentication over gRPC failed", "error", err, "reason", ReasonOf(err))
+		return nil, grpcError(err, "failed to authenticate")
+	}
+	if authn.Degraded {
+		if err := grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(DegradedHeader), "true")); err != nil {
+			slog.WarnContext(ctx, "Failed to mark degraded authentication", "error", err)
+		}
+	}
+
+	return &authv1.AuthenticateResponse{Claims: claimsToProto(authn.JWTClaims)}, nil
+}
+
+// authnRequirementFromProto mirrors parseAuthnRequirement for gRPC requests.
+func authnRequirementFromProto(req *authv1.AuthenticateRequest) *AuthnRequirement {
+	requirement := &AuthnRequirement{ACRValues: req.GetAcrValues(), MaxAge: -1}
+	if req.MaxAge != nil {
+		requirement.MaxAge = time.Duration(req.GetMaxAge()) * time.Second
+	}
+
+	if len(requirement.ACRValues) == 0 && requirement.MaxAge < 0 {
+		return nil
+	}
+	return requirement
+}
+
+func (s *AuthGRPCServer) resolveTenant(ctx context.Context) (*tenant.Tenant, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	header := make(http.Header, len(md))
+	for key, values := range md {
+		header[http.CanonicalHeaderKey(key)] = values
+	}
+
+	var host string
+	if authority := md.Get(":authority"); len(authority) > 0 {
+		host = authority[0]
+	}
+
+	t, err := s.tenants.ResolveHeaders(host, header)
+	if err != nil {
+		return nil, grpcError(err, "unknown tenant")
+	}
+	return t, nil
+}
+
+// grpcSender collects the client certificate verified by the TLS handshake of the gRPC connection.
+func grpcSender(ctx context.Context) *Sender {
+	sender := &Sender{}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if identity, ok := mtls.FromConnectionState(info.State); ok {
+				sender.CertificateThumbprint = identity.Thumbprint
+			}
+		}
+	}
+	return sender
+}
+
+// grpcError converts a service error into a status carrying the failure reason
+// in an ErrorInfo detail, so that clients can react to it like to HTTP problem codes.
+func grpcError(err error, message string) error {
+	reason := ReasonOf(err)
+	metrics.Failures.WithLabelValues(string(reason)).Inc()
+
+	var code codes.Code
+	switch reason {
+	case ReasonInvalidRequest, ReasonInvalidScope:
+		code = codes.InvalidArgument
+	case ReasonUnknownTenant:
+		code = codes.NotFound
+	case ReasonCacheUnavailable:
+		code = codes.Unavailable
+	case ReasonInvalidCSRFToken, ReasonExchangeNotPermitted:
+		code = codes.PermissionDenied
+	case ReasonInternalError:
+		code = codes.Internal
+	default:
+		code = codes.Unauthenticated
+	}
+
+	info := &errdetails.ErrorInfo{
+		Reason: string(reason),
+		Domain: grpcErrorDomain,
+	}
+	// Like the WWW-Authenticate challenge, step-up failures tell the client what to ask the user for
+	var stepUp *StepUpError
+	if errors.As(err, &stepUp) {
+		info.Metadata = map[string]string{}
+		if len(stepUp.Requirement.ACRValues) > 0 {
+			info.Metadata["acr_values"] = strings.Join(stepUp.Requirement.ACRValues, " ")
+		}
+		if stepUp.Requirement.MaxAge >= 0 {
+			info.Metadata["max_age"] = strconv.FormatInt(int64(stepUp.Requirement.MaxAge.Seconds()), 10)
+		}
+	}
+
+	st, detailErr := status.New(code, message).WithDetails(info)
+	if detailErr != nil {
+		return status.Error(code, message)
+	}
+	return st.Err()
+}
+
+func claimsToProto(claims *authjwt.JWTClaims) *authv1.Claims {
+	return &authv1.Claims{
+		Sub:      claims.Subject,
+		Uid:      claims.UID,
+		Type:     claims.Type,
+		Scope:    claims.Scope,
+		Iss:      claims.Issuer,
+		Exp:      timestampOrNil(claims.ExpiresAt),
+		Iat:      timestampOrNil(claims.IssuedAt),
+		Nbf:      timestampOrNil(claims.NotBefore),
+		Cnf:      confirmationToProto(claims.Confirmation),
+		Act:      actorToProto(claims.Actor),
+		AuthTime: timestampOrNil(claims.AuthTime),
+		Acr:      claims.ACR,
+		Amr:      claims.AMR,
+	}
+}
+
+func confirmationToProto(cnf *authjwt.Confirmation) *authv1.Confirmation {
+	if cnf == nil {
+		return nil
+	}
+	return &authv1.Confirmation{X5TS256: cnf.X5TS256, Jkt: cnf.JKT}
+}
+
+func actorToProto(actor *authjwt.Actor) *authv1.Actor {
+	if actor == nil {
+		return nil
+	}
+	return &authv1.Actor{Sub: actor.Subject, Act: actorToProto(actor.Actor)}
+}
+
+func timestampOrNil(date *jwt.NumericDate) *timestamppb.Timestamp {
+	if date == nil {
+		return nil
+	}
+	return timestamppb.New(date.Time)
+}
@@ -2,9 +2,23 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/audit"
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/dpop"
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/spf13/viper"
 )
 
 type AuthHandler interface {
@@ -12,64 +26,135 @@ type AuthHandler interface {
 	Refresh(w http.ResponseWriter, r *http.Request)
 	Logout(w http.ResponseWriter, r *http.Request)
 	Authenticate(w http.ResponseWriter, r *http.Request)
+	ForwardAuth(w http.ResponseWriter, r *http.Request)
+	TokenExchange(w http.ResponseWriter, r *http.Request)
+	RateLimitSubject(route string, r *http.Request) (string, bool)
 }
 
 type AuthHandlerImpl struct {
-	service AuthService
+	service         AuthService
+	tenants         tenant.Registry
+	cookies         TokenCookies
+	credentials     CredentialExtractor
+	jwtService      authjwt.JWTService
+	forwardHeaders  forwardAuthHeaders
+	realm           string
+	bindToCert      bool
+	proofs          dpop.Verifier
+	exchangeEnabled bool
+	trustedProxies  []netip.Prefix // may describe the original request of a DPoP proof
 }
 
-func NewAuthHandler(service AuthService) AuthHandler {
+func NewAuthHandler(service AuthService, tenants tenant.Registry, proofs dpop.Verifier) AuthHandler {
+	cookies := NewTokenCookies()
 	return &AuthHandlerImpl{
-		service: service,
+		service:         service,
+		tenants:         tenants,
+		cookies:         cookies,
+		credentials:     NewCredentialExtractor(cookies),
+		jwtService:      authjwt.NewJWTService(),
+		forwardHeaders:  newForwardAuthHeaders(),
+		realm:           config.StringOrDefault("auth.realm", "jwt-microservice"),
+		bindToCert:      viper.GetBool("auth.certificate_binding"),
+		proofs:          proofs,
+		exchangeEnabled: viper.GetBool("token_exchange.enabled"),
+		trustedProxies:  newTrustedProxies(),
 	}
 }
 
 func (h *AuthHandlerImpl) Login(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		slog.Warn("Invalid method for login", "method", r.Method, "path", r.URL.Path)
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method for login", "method", r.Method, "path", r.URL.Path)
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+
+	t, ok := h.resolveTenant(w, r)
+	if !ok {
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		slog.Error("Failed to read login request body", "error", err)
-		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		slog.ErrorContext(r.Context(), "Failed to read login request body", "error", err)
+		writeBodyError(w, r, err)
 		return
 	}
 
 	type loginRequest struct {
-		UserID uint `json:"user_id"`
+		Subject string      `json:"sub"`
+		UserID  json.Number `json:"user_id"` // legacy numeric subject
+		Scope   string      `json:"scope"`
+		// How the subject authenticated, reported by the identity provider
+		ACR      string   `json:"acr"`
+		AMR      []string `json:"amr"`
+		AuthTime int64    `json:"auth_time"` // seconds since the epoch, defaults to now
 	}
 
 	var req loginRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		slog.Error("Failed to unmarshal login request", "error", err)
-		http.Error(w, "failed to unmarshal request body", http.StatusBadRequest)
+		slog.ErrorContext(r.Context(), "Failed to unmarshal login request", "error", err)
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "request body is not valid JSON")
+		return
+	}
+
+	subject := req.Subject
+	if subject == "" {
+		subject = req.UserID.String()
+	}
+	if subject == "" {
+		slog.WarnContext(r.Context(), "Missing subject in login request")
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "missing subject")
+		return
+	}
+
+	var authTime time.Time
+	if req.AuthTime != 0 {
+		authTime = time.Unix(req.AuthTime, 0)
+	}
+	if err := checkAuthTime(authTime); err != nil {
+		slog.WarnContext(r.Context(), "Invalid auth_time in login request", "auth_time", req.AuthTime)
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, err.Error())
 		return
 	}
 
-	slog.Info("Processing login request", "user_id", req.UserID)
-	tokenPair, err := h.service.Login(req.UserID)
+	sender, err := h.sender(w, r, t, nil)
 	if err != nil {
-		slog.Error("Failed to login user", "error", err, "user_id", req.UserID)
-		http.Error(w, "failed to login", http.StatusInternalServerError)
+		slog.WarnContext(r.Context(), "Login request carries an invalid proof", "error", err, "reason", ReasonOf(err))
+		h.writeError(w, r, err)
 		return
 	}
-	slog.Info("Login successful", "user_id", req.UserID)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(tokenPair); err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	grant := &authjwt.Grant{
+		Subject:      subject,
+		Scope:        req.Scope,
+		Confirmation: confirmationFor(sender, h.bindToCert),
+		AuthTime:     authTime,
+		ACR:          req.ACR,
+		AMR:          req.AMR,
+	}
+
+	slog.InfoContext(r.Context(), "Processing login request", "tenant", t.ID, "sub", subject, "bound", grant.Confirmation != nil, "acr", req.ACR)
+	tokenPair, err := h.service.Login(r.Context(), t, grant)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to login user", "error", err, "reason", ReasonOf(err), "sub", subject)
+		h.writeError(w, r, err)
 		return
 	}
+	slog.InfoContext(r.Context(), "Login successful", "sub", subject)
+
+	h.writeTokenPair(w, r, t, tokenPair)
 }
 
 func (h *AuthHandlerImpl) Refresh(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		slog.Warn("Invalid method for refresh", "method", r.Method, "path", r.URL.Path)
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method for refresh", "method", r.Method, "path", r.URL.Path)
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+
+	t, ok := h.resolveTenant(w, r)
+	if !ok {
 		return
 	}
 
@@ -78,85 +163,206 @@ func (h *AuthHandlerImpl) Refresh(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req refreshRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		slog.Error("Failed to decode refresh request", "error", err)
-		http.Error(w, "failed to unmarshal request body", http.StatusBadRequest)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !(errors.Is(err, io.EOF) && h.cookies.Enabled()) {
+		slog.ErrorContext(r.Context(), "Failed to decode refresh request", "error", err)
+		writeBodyError(w, r, err)
 		return
 	}
 
-	slog.Info("Processing refresh token request")
-	tokenPair, err := h.service.Refresh(req.RefreshToken)
+	refreshToken := req.RefreshToken
+	if refreshToken == "" {
+		var err error
+		if refreshToken, err = h.cookies.RefreshToken(r); err != nil {
+			slog.WarnContext(r.Context(), "Refresh request carries no token", "error", err)
+			recordEvent(r.Context(), audit.TypeRefresh, t, "", "", err)
+			h.writeError(w, r, err)
+			return
+		}
+	}
+
+	sender, err := h.sender(w, r, t, nil)
 	if err != nil {
-		slog.Error("Failed to refresh token", "error", err)
-		http.Error(w, "failed to refresh token", http.StatusInternalServerError)
+		slog.WarnContext(r.Context(), "Refresh request carries an invalid proof", "error", err, "reason", ReasonOf(err))
+		recordEvent(r.Context(), audit.TypeRefresh, t, "", "", err)
+		h.writeError(w, r, err)
 		return
 	}
-	slog.Info("Token refresh successful")
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(tokenPair); err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	slog.InfoContext(r.Context(), "Processing refresh token request", "tenant", t.ID)
+	tokenPair, err := h.service.Refresh(r.Context(), t, refreshToken, sender)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to refresh token", "error", err, "reason", ReasonOf(err))
+		h.writeError(w, r, err)
 		return
 	}
+	slog.InfoContext(r.Context(), "Token refresh successful")
+
+	h.writeTokenPair(w, r, t, tokenPair)
 }
 
 func (h *AuthHandlerImpl) Logout(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		slog.Warn("Invalid method for logout", "method", r.Method, "path", r.URL.Path)
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method for logout", "method", r.Method, "path", r.URL.Path)
+		problem.MethodNotAllowed(w, r)
 		return
 	}
 
-	accessToken := r.Header.Get("Authorization")
-	if accessToken == "" {
-		slog.Warn("Missing authorization header in logout request")
-		http.Error(w, "missing authorization header", http.StatusBadRequest)
+	t, ok := h.resolveTenant(w, r)
+	if !ok {
 		return
 	}
 
-	accessToken = accessToken[len("Bearer "):]
-	slog.Info("Processing logout request")
+	credential, err := h.credentials.AccessToken(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Request carries no valid credentials", "error", err)
+		recordEvent(r.Context(), audit.TypeLogout, t, "", "", err)
+		h.writeError(w, r, err)
+		return
+	}
 
-	if err := h.service.Logout(accessToken); err != nil {
-		slog.Error("Failed to logout", "error", err)
-		http.Error(w, "failed to logout", http.StatusInternalServerError)
+	sender, err := h.sender(w, r, t, credential)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Request carries an invalid proof", "error", err, "reason", ReasonOf(err))
+		recordEvent(r.Context(), audit.TypeLogout, t, "", "", err)
+		h.writeError(w, r, err)
 		return
 	}
-	slog.Info("Logout successful")
 
+	slog.InfoContext(r.Context(), "Processing logout request", "tenant", t.ID)
+
+	if err = h.service.Logout(r.Context(), t, credential.Token, sender); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to logout", "error", err, "reason", ReasonOf(err))
+		h.writeError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Logout successful")
+
+	if h.cookies.Enabled() {
+		h.cookies.Clear(w)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func (h *AuthHandlerImpl) Authenticate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		slog.Warn("Invalid method for authenticate", "method", r.Method, "path", r.URL.Path)
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method for authenticate", "method", r.Method, "path", r.URL.Path)
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+
+	t, ok := h.resolveTenant(w, r)
+	if !ok {
+		return
+	}
+
+	requirement, err := parseAuthnRequirement(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid authentication requirement", "error", err)
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, err.Error())
 		return
 	}
 
-	accessToken := r.Header.Get("Authorization")
-	if accessToken == "" {
-		slog.Warn("Missing authorization header in authenticate request")
-		http.Error(w, "missing authorization header", http.StatusBadRequest)
+	credential, err := h.credentials.AccessToken(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Request carries no valid credentials", "error", err)
+		recordEvent(r.Context(), audit.TypeAuthentication, t, "", "", err)
+		h.writeError(w, r, err)
+		return
+	}
+
+	sender, err := h.sender(w, r, t, credential)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Request carries an invalid proof", "error", err, "reason", ReasonOf(err))
+		recordEvent(r.Context(), audit.TypeAuthentication, t, "", "", err)
+		h.writeError(w, r, err)
 		return
 	}
 
-	accessToken = accessToken[len("Bearer "):]
-	slog.Info("Processing authentication request")
+	slog.InfoContext(r.Context(), "Processing authentication request", "tenant", t.ID)
 
-	claims, err := h.service.Authenticate(accessToken)
+	authn, err := h.service.Authenticate(r.Context(), t, credential.Token, sender, requirement)
 	if err != nil {
-		slog.Error("Authentication failed", "error", err)
-		http.Error(w, "failed to authenticate", http.StatusBadRequest)
+		slog.ErrorContext(r.Context(), "Authentication failed", "error", err, "reason", ReasonOf(err))
+		h.writeError(w, r, err)
 		return
 	}
-	slog.Info("Authentication successful", "user_id", claims.UserID)
+	claims := authn.JWTClaims
+	slog.InfoContext(r.Context(), "Authentication successful", "sub", claims.Subject, "degraded", authn.Degraded)
 
+	if authn.Degraded {
+		w.Header().Set(DegradedHeader, "true")
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(claims); err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to encode authenticate response", "error", err)
+	}
+}
+
+func (h *AuthHandlerImpl) resolveTenant(w http.ResponseWriter, r *http.Request) (*tenant.Tenant, bool) {
+	t, err := h.tenants.Resolve(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to resolve tenant", "error", err, "host", r.Host, "path", r.URL.Path)
+		h.writeError(w, r, err)
+		return nil, false
+	}
+	return t, true
+}
+
+// writeError responds with the problem matching err.
+// Failed credential checks also carry an RFC 6750 WWW-Authenticate challenge.
+func (h *AuthHandlerImpl) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	p := problemFromError(err)
+	reason := ReasonOf(err)
+	metrics.Failures.WithLabelValues(string(reason)).Inc()
+	if p.Status == http.StatusUnauthorized || reason == ReasonMalformedCredentials {
+		scheme := SchemeBearer
+		if credential, err := parseAuthorization(r.Header.Get("Authorization")); err == nil {
+			scheme = credential.Scheme
+		}
+		if reason == ReasonInvalidDPoPProof || reason == ReasonUseDPoPNonce {
+			scheme = SchemeDPoP
+		}
+
+		value := challenge(scheme, h.realm, reason, p)
+		var stepUp *StepUpError
+		if errors.As(err, &stepUp) {
+			value += stepUp.challengeParams()
+		}
+		if scheme == SchemeDPoP && h.proofs.Enabled() {
+			value += fmt.Sprintf(", algs=%q", strings.Join(h.proofs.Algorithms(), " "))
+		}
+		w.Header().Set("WWW-Authenticate", value)
+	}
+	problem.Write(w, r, p)
+}
+
+// writeBodyError reports a request body that could not be read or decoded.
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		problem.Error(w, r, http.StatusRequestEntityTooLarge, problem.CodeRequestTooLarge, "request body is too large")
 		return
 	}
+	problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "request body could not be read or is not valid JSON")
+}
+
+// writeTokenPair sends the token pair in HttpOnly cookies when cookie delivery is enabled
+// and in the JSON response body otherwise.
+func (h *AuthHandlerImpl) writeTokenPair(w http.ResponseWriter, r *http.Request, t *tenant.Tenant, tokenPair *TokenPair) {
+	if h.cookies.Enabled() {
+		if err := h.cookies.Set(w, t, tokenPair); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to set token cookies", "error", err)
+			h.writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(tokenPair); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode token pair response", "error", err)
+	}
 }
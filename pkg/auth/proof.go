@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/dpop"
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/GregoryKogan/jwt-microservice/pkg/server"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+)
+
+var ErrMissingProof = errors.New("missing DPoP proof")
+
+// sender collects the keys the request proves possession of: the client certificate of the
+// connection and the key of its DPoP proof. A proof is verified whenever one is presented, and
+// required when the access token is presented with the DPoP scheme. Proofs accompanying an access
+// token must carry its hash, and requests presenting proofs receive a fresh nonce to use next.
+func (h *AuthHandlerImpl) sender(w http.ResponseWriter, r *http.Request, t *tenant.Tenant, credential *Credential) (*Sender, error) {
+	sender := senderFromContext(r.Context())
+
+	proofs := r.Header.Values(dpop.Header)
+	dpopScheme := credential != nil && credential.Scheme == SchemeDPoP
+	if !h.proofs.Enabled() || (len(proofs) == 0 && !dpopScheme) {
+		return sender, nil
+	}
+
+	w.Header().Set(dpop.NonceHeader, h.proofs.Nonce(t))
+	switch {
+	case len(proofs) == 0:
+		return nil, errors.Join(dpop.ErrInvalidProof, ErrMissingProof)
+	case len(proofs) > 1:
+		return nil, errors.Join(dpop.ErrInvalidProof, errors.New("more than one DPoP proof"))
+	}
+
+	forwarded := h.forwarded(r)
+	req := &dpop.Request{Method: originalMethod(r, forwarded), URI: requestURI(r, forwarded)}
+	if credential != nil {
+		// Bearer tokens do not prove possession of the key, so a bound token sent as one fails the binding check
+		if !dpopScheme {
+			return sender, nil
+		}
+		req.AccessToken = credential.Token
+	}
+
+	proof, err := h.proofs.Verify(r.Context(), t, proofs[0], req)
+	if err != nil {
+		return nil, err
+	}
+	sender.KeyThumbprint = proof.KeyThumbprint
+	return sender, nil
+}
+
+// newTrustedProxies reads the proxies allowed to describe the original request of a proof.
+// Invalid networks are rejected at startup, so they are only logged here.
+func newTrustedProxies() []netip.Prefix {
+	trustedProxies, err := server.TrustedProxies()
+	if err != nil {
+		slog.Error("Failed to parse trusted proxies", slog.Any("error", err))
+	}
+	return trustedProxies
+}
+
+// forwarded reports whether r comes from a trusted proxy, whose headers describe the original request.
+func (h *AuthHandlerImpl) forwarded(r *http.Request) bool {
+	return middleware.IsTrustedProxy(r.RemoteAddr, h.trustedProxies)
+}
+
+// originalMethod returns the method of the request a trusted proxy asks about, or the method of r itself.
+// Headers of other peers are ignored, or a proof made for another request could be replayed here.
+func originalMethod(r *http.Request, forwarded bool) string {
+	if forwarded {
+		for _, name := range []string{"X-Forwarded-Method", "X-Original-Method"} {
+			if method := r.Header.Get(name); method != "" {
+				return strings.ToUpper(method)
+			}
+		}
+	}
+	return r.Method
+}
+
+// requestURI reconstructs the URI the client sent the request to. Trusted proxies name the original
+// request in X-Original-URL or in the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Uri headers.
+func requestURI(r *http.Request, forwarded bool) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if !forwarded {
+		return scheme + "://" + r.Host + r.URL.RequestURI()
+	}
+
+	if original := r.Header.Get("X-Original-URL"); original != "" {
+		return original
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	host := r.Host
+	if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+		host = forwardedHost
+	}
+
+	path := r.URL.RequestURI()
+	if forwardedURI := r.Header.Get("X-Forwarded-Uri"); forwardedURI != "" {
+		path = forwardedURI
+	}
+	return scheme + "://" + host + path
+}
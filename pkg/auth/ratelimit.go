@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+)
+
+// RateLimitSubject identifies the subject of a request to route for per-user rate limits,
+// before the request is handled: at login the subject being logged in, elsewhere the subject
+// of the presented refresh or access token. Only validly signed tokens count so that clients
+// cannot exhaust the limits of others; they are not checked for revocation.
+// Subjects are scoped by tenant.
+func (h *AuthHandlerImpl) RateLimitSubject(route string, r *http.Request) (string, bool) {
+	t, err := h.tenants.Resolve(r)
+	if err != nil {
+		return "", false
+	}
+
+	var subject string
+	switch route {
+	case "login":
+		var req struct {
+			Subject string      `json:"sub"`
+			UserID  json.Number `json:"user_id"`
+		}
+		if json.Unmarshal(peekBody(r), &req) != nil {
+			return "", false
+		}
+		subject = req.Subject
+		if subject == "" {
+			subject = req.UserID.String()
+		}
+	case "refresh":
+		var req struct {
+			RefreshToken string `json:"refresh"`
+		}
+		_ = json.Unmarshal(peekBody(r), &req)
+		if req.RefreshToken == "" {
+			req.RefreshToken, _ = h.cookies.RefreshToken(r)
+		}
+		subject = h.tokenSubject(r, t, req.RefreshToken)
+	default:
+		if credential, err := h.credentials.AccessToken(r); err == nil {
+			subject = h.tokenSubject(r, t, credential.Token)
+		}
+	}
+
+	if subject == "" {
+		return "", false
+	}
+	return t.ID + ":" + subject, true
+}
+
+func (h *AuthHandlerImpl) tokenSubject(r *http.Request, t *tenant.Tenant, token string) string {
+	if token == "" {
+		return ""
+	}
+	claims, err := h.jwtService.ParseToken(r.Context(), t, token)
+	if err != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// peekBody reads the body of r and puts it back for the handler, along with any error
+// that reading it failed with, such as the body exceeding the size limit.
+func peekBody(r *http.Request) []byte {
+	if r.Body == nil {
+		return nil
+	}
+	body, _ := io.ReadAll(r.Body)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body
+}
@@ -5,19 +5,32 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tracing"
 	"github.com/redis/go-redis/v9"
-	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var tracer = otel.Tracer("github.com/GregoryKogan/jwt-microservice/pkg/auth")
+
 var ErrInvalidTokenPair = errors.New("invalid token pair")
 
 type AuthRepo interface {
-	CacheTokenPair(tokenPair *TokenPair) error
-	ExtendTokenPairCacheExpiration(userID uint)
-	IsTokenCached(claims *authjwt.JWTClaims) (bool, error)
-	DeleteTokenPair(userID uint)
+	CacheTokenPair(ctx context.Context, t *tenant.Tenant, tokenPair *TokenPair) error
+	ExtendTokenPairCacheExpiration(ctx context.Context, t *tenant.Tenant, subject string)
+	IsTokenCached(ctx context.Context, t *tenant.Tenant, claims *authjwt.JWTClaims) (bool, error)
+	DeleteTokenPair(ctx context.Context, t *tenant.Tenant, subject string) error
+	CacheExchangedToken(ctx context.Context, t *tenant.Tenant, token string) error
+	DeleteExchangedToken(ctx context.Context, t *tenant.Tenant, uid string) error
+	ClaimProof(ctx context.Context, t *tenant.Tenant, id string, ttl time.Duration) (bool, error)
+	CountSessions(ctx context.Context, t *tenant.Tenant) (int64, error)
+	Close(ctx context.Context) error
 }
 
 type TokenPair struct {
@@ -25,15 +38,30 @@ type TokenPair struct {
 	Refresh string `json:"refresh"`
 }
 
+// AuthRepoImpl bounds every Redis operation by a timeout on top of the deadline of the request,
+// so a slow cache fails requests quickly instead of piling them up.
 type AuthRepoImpl struct {
 	cache      *redis.Client
 	jwtService authjwt.JWTService
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	scanTimeout  time.Duration
+	expirations  *expirationWriter
+	verified     *verificationCache // nil unless the local cache is enabled
 }
 
+// NewAuthRepo starts a background writer for session extensions and, when enabled, the
+// subscription of the local verification cache, which Close stops.
 func NewAuthRepo(cache *redis.Client) AuthRepo {
 	return &AuthRepoImpl{
-		cache:      cache,
-		jwtService: authjwt.NewJWTService(),
+		cache:        cache,
+		jwtService:   authjwt.NewJWTService(),
+		readTimeout:  config.DurationOrDefault("cache.timeouts.read", 250*time.Millisecond),
+		writeTimeout: config.DurationOrDefault("cache.timeouts.write", 500*time.Millisecond),
+		scanTimeout:  config.DurationOrDefault("cache.timeouts.scan", 10*time.Second),
+		expirations:  newExpirationWriter(cache),
+		verified:     newVerificationCache(cache),
 	}
 }
 
@@ -42,19 +70,22 @@ type tokenUIDPair struct {
 	RefreshUID string `json:"refresh_uid"`
 }
 
-func (r *AuthRepoImpl) CacheTokenPair(tokenPair *TokenPair) error {
-	accessClaims, err := r.jwtService.ParseToken(tokenPair.Access)
+func (r *AuthRepoImpl) CacheTokenPair(ctx context.Context, t *tenant.Tenant, tokenPair *TokenPair) (err error) {
+	ctx, span := startSpan(ctx, "AuthRepo.CacheTokenPair", t)
+	defer func() { tracing.End(span, err) }()
+
+	accessClaims, err := r.jwtService.ParseToken(ctx, t, tokenPair.Access)
 	if err != nil {
 		return err
 	}
 
-	refreshClaims, err := r.jwtService.ParseToken(tokenPair.Refresh)
+	refreshClaims, err := r.jwtService.ParseToken(ctx, t, tokenPair.Refresh)
 	if err != nil {
 		return err
 	}
 
-	if accessClaims.UserID != refreshClaims.UserID {
-		return errors.Join(ErrInvalidTokenPair, errors.New("user IDs do not match"))
+	if accessClaims.Subject != refreshClaims.Subject {
+		return errors.Join(ErrInvalidTokenPair, errors.New("subjects do not match"))
 	}
 
 	cached := tokenUIDPair{
@@ -67,22 +98,57 @@ func (r *AuthRepoImpl) CacheTokenPair(tokenPair *TokenPair) error {
 		return err
 	}
 
-	userID := accessClaims.UserID
-	return r.cache.Set(context.Background(), fmt.Sprintf("token-%d", userID), cacheJson, viper.GetDuration("auth.auto_logout")).Err()
+	ctx, cancel := context.WithTimeout(ctx, r.writeTimeout)
+	defer cancel()
+	key := tokenPairKey(t, accessClaims.Subject)
+	if err := r.cache.Set(ctx, key, cacheJson, t.AutoLogout).Err(); err != nil {
+		return errors.Join(ErrCacheUnavailable, err)
+	}
+	// The new pair replaces the previous session of the subject
+	r.revoke(ctx, key)
+	return nil
 }
 
-func (r *AuthRepoImpl) ExtendTokenPairCacheExpiration(userID uint) {
-	go func() {
-		r.cache.Expire(context.Background(), fmt.Sprintf("token-%d", userID), viper.GetDuration("auth.auto_logout"))
-	}()
+// ExtendTokenPairCacheExpiration slides the expiration of a session. The extension is queued
+// and written in the background, coalesced with other extensions of the same session.
+func (r *AuthRepoImpl) ExtendTokenPairCacheExpiration(ctx context.Context, t *tenant.Tenant, subject string) {
+	r.expirations.Extend(tokenPairKey(t, subject), t.AutoLogout)
 }
 
-func (r *AuthRepoImpl) IsTokenCached(claims *authjwt.JWTClaims) (bool, error) {
-	cacheJson, err := r.cache.Get(context.Background(), fmt.Sprintf("token-%d", claims.UserID)).Result()
+func (r *AuthRepoImpl) IsTokenCached(ctx context.Context, t *tenant.Tenant, claims *authjwt.JWTClaims) (ok bool, err error) {
+	ctx, span := startSpan(ctx, "AuthRepo.IsTokenCached", t)
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, r.readTimeout)
+	defer cancel()
+
+	key := tokenPairKey(t, claims.Subject)
+	if claims.Type == "exchanged" {
+		key = exchangedTokenKey(t, claims.UID)
+	}
+	// Refresh tokens are single-use, so they are always checked in Redis
+	local := r.verified != nil && claims.Type != "refresh"
+	if local && r.verified.Get(claims.UID) {
+		span.SetAttributes(attribute.Bool("local", true))
+		return true, nil
+	}
+
+	checkedAt := time.Now()
+	defer func() {
+		if local && ok {
+			r.verified.Add(claims.UID, key, checkedAt)
+		}
+	}()
+
+	if claims.Type == "exchanged" {
+		return r.isExchangedTokenCached(ctx, t, claims)
+	}
+
+	cacheJson, err := r.cache.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return false, nil // No such key in Redis cache
 	} else if err != nil {
-		return false, errors.Join(errors.New("failed to get token from cache"), err)
+		return false, errors.Join(ErrCacheUnavailable, errors.New("failed to get token from cache"), err)
 	}
 
 	var cached tokenUIDPair
@@ -97,12 +163,138 @@ func (r *AuthRepoImpl) IsTokenCached(claims *authjwt.JWTClaims) (bool, error) {
 	case "refresh":
 		cachedUID = cached.RefreshUID
 	default:
-		return false, fmt.Errorf("invalid token type: %s", claims.Type)
+		return false, errors.Join(ErrInvalidTokenType, fmt.Errorf("unknown token type: %s", claims.Type))
 	}
 
 	return claims.UID == cachedUID, nil
 }
 
-func (r *AuthRepoImpl) DeleteTokenPair(userID uint) {
-	r.cache.Del(context.Background(), fmt.Sprintf("token-%d", userID))
+// DeleteTokenPair revokes a session. A client that disconnects mid-logout must not leave the
+// session alive, so the deletion is not cancelled with the request.
+func (r *AuthRepoImpl) DeleteTokenPair(ctx context.Context, t *tenant.Tenant, subject string) (err error) {
+	ctx, span := startSpan(ctx, "AuthRepo.DeleteTokenPair", t)
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.writeTimeout)
+	defer cancel()
+	key := tokenPairKey(t, subject)
+	if err := r.cache.Del(ctx, key).Err(); err != nil {
+		return errors.Join(ErrCacheUnavailable, err)
+	}
+	r.revoke(ctx, key)
+	return nil
+}
+
+// CacheExchangedToken records a token issued in a token exchange until it expires.
+// Exchanged tokens are not part of the token pair of their subject, so rotating or
+// revoking the session does not affect them; they are kept short-lived instead.
+func (r *AuthRepoImpl) CacheExchangedToken(ctx context.Context, t *tenant.Tenant, token string) (err error) {
+	ctx, span := startSpan(ctx, "AuthRepo.CacheExchangedToken", t)
+	defer func() { tracing.End(span, err) }()
+
+	claims, err := r.jwtService.ParseToken(ctx, t, token)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.writeTimeout)
+	defer cancel()
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if err := r.cache.Set(ctx, exchangedTokenKey(t, claims.UID), claims.Subject, ttl).Err(); err != nil {
+		return errors.Join(ErrCacheUnavailable, err)
+	}
+	return nil
+}
+
+func (r *AuthRepoImpl) DeleteExchangedToken(ctx context.Context, t *tenant.Tenant, uid string) (err error) {
+	ctx, span := startSpan(ctx, "AuthRepo.DeleteExchangedToken", t)
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.writeTimeout)
+	defer cancel()
+	key := exchangedTokenKey(t, uid)
+	if err := r.cache.Del(ctx, key).Err(); err != nil {
+		return errors.Join(ErrCacheUnavailable, err)
+	}
+	r.revoke(ctx, key)
+	return nil
+}
+
+func (r *AuthRepoImpl) isExchangedTokenCached(ctx context.Context, t *tenant.Tenant, claims *authjwt.JWTClaims) (bool, error) {
+	subject, err := r.cache.Get(ctx, exchangedTokenKey(t, claims.UID)).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Join(ErrCacheUnavailable, errors.New("failed to get exchanged token from cache"), err)
+	}
+	return subject == claims.Subject, nil
+}
+
+// ClaimProof records the ID of a DPoP proof, reporting false if it has been used before.
+func (r *AuthRepoImpl) ClaimProof(ctx context.Context, t *tenant.Tenant, id string, ttl time.Duration) (fresh bool, err error) {
+	ctx, span := startSpan(ctx, "AuthRepo.ClaimProof", t)
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, r.writeTimeout)
+	defer cancel()
+	fresh, err = r.cache.SetNX(ctx, proofKey(t, id), 1, ttl).Result()
+	if err != nil {
+		return false, errors.Join(ErrCacheUnavailable, err)
+	}
+	return fresh, nil
+}
+
+// CountSessions counts the token pairs of a tenant. It scans the keyspace incrementally,
+// so it does not block Redis but takes time proportional to the number of keys.
+func (r *AuthRepoImpl) CountSessions(ctx context.Context, t *tenant.Tenant) (count int64, err error) {
+	ctx, span := startSpan(ctx, "AuthRepo.CountSessions", t)
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, r.scanTimeout)
+	defer cancel()
+	iter := r.cache.Scan(ctx, 0, globEscaper.Replace(tokenPairKey(t, ""))+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		count++
+	}
+	if err := iter.Err(); err != nil {
+		return 0, errors.Join(ErrCacheUnavailable, err)
+	}
+	return count, nil
+}
+
+// revoke drops the tokens revoked by deleting or replacing key from the local verification
+// cache of every instance.
+func (r *AuthRepoImpl) revoke(ctx context.Context, key string) {
+	if r.verified == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.writeTimeout)
+	defer cancel()
+	r.verified.Revoke(ctx, key)
+}
+
+// Close writes the queued session extensions and stops the background writer and the
+// subscription of the local verification cache.
+func (r *AuthRepoImpl) Close(ctx context.Context) error {
+	err := r.expirations.Close(ctx)
+	if r.verified != nil {
+		err = errors.Join(err, r.verified.Close())
+	}
+	return err
+}
+
+// globEscaper escapes the characters SCAN patterns give a special meaning, so that tenant
+// IDs match only themselves.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func tokenPairKey(t *tenant.Tenant, subject string) string {
+	return t.CacheKey("token-" + subject)
+}
+
+func proofKey(t *tenant.Tenant, id string) string {
+	return t.CacheKey("dpop-jti-" + id)
+}
+
+func exchangedTokenKey(t *tenant.Tenant, uid string) string {
+	return t.CacheKey("exchanged-" + uid)
 }
@@ -1,63 +1,161 @@
 package auth
 
 import (
+	"context"
 	"errors"
+	"time"
 
+	"github.com/GregoryKogan/jwt-microservice/pkg/audit"
 	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var ErrInvalidToken = errors.New("invalid token")
-
 type AuthService interface {
-	Authenticate(accessToken string) (*authjwt.JWTClaims, error)
-	Login(userID uint) (*TokenPair, error)
-	Refresh(refreshToken string) (*TokenPair, error)
-	Logout(accessToken string) error
+	Authenticate(ctx context.Context, t *tenant.Tenant, accessToken string, sender *Sender, requirement *AuthnRequirement) (*Authentication, error)
+	Login(ctx context.Context, t *tenant.Tenant, grant *authjwt.Grant) (*TokenPair, error)
+	Refresh(ctx context.Context, t *tenant.Tenant, refreshToken string, sender *Sender) (*TokenPair, error)
+	Logout(ctx context.Context, t *tenant.Tenant, accessToken string, sender *Sender) error
+	Exchange(ctx context.Context, t *tenant.Tenant, req *ExchangeRequest) (*ExchangeResult, error)
 }
 
 type AuthServiceImpl struct {
-	repo       AuthRepo
-	jwtService authjwt.JWTService
+	repo           AuthRepo
+	jwtService     authjwt.JWTService
+	exchangeConfig exchangeConfig
+	degraded       *degradedPolicy
+	acrLevels      acrLevels
 }
 
 func NewAuthService(repo AuthRepo) AuthService {
 	return &AuthServiceImpl{
-		repo:       repo,
-		jwtService: authjwt.NewJWTService(),
+		repo:           repo,
+		jwtService:     authjwt.NewJWTService(),
+		exchangeConfig: newExchangeConfig(),
+		degraded:       newDegradedPolicy(),
+		acrLevels:      newACRLevels(),
 	}
 }
 
-func (s *AuthServiceImpl) Authenticate(accessToken string) (*authjwt.JWTClaims, error) {
-	claims, err := s.jwtService.ParseToken(accessToken)
+// Authenticate validates an access token and, unless requirement is nil, the authentication it
+// records. While the circuit breaker of the cache is open, the degraded policy may accept the
+// token without checking it for revocation.
+func (s *AuthServiceImpl) Authenticate(ctx context.Context, t *tenant.Tenant, accessToken string, sender *Sender, requirement *AuthnRequirement) (authn *Authentication, err error) {
+	ctx, span := startSpan(ctx, "AuthService.Authenticate", t)
+	defer func() { tracing.End(span, err) }()
+
+	var claims *authjwt.JWTClaims
+	defer func() {
+		// Successful authentications are too frequent to be audited
+		if err != nil {
+			recordTokenEvent(ctx, audit.TypeAuthentication, t, claims, err)
+		}
+	}()
+
+	claims, err = s.parseAccessToken(ctx, t, accessToken)
 	if err != nil {
 		return nil, err
 	}
 
-	if claims.Type != "access" {
-		return nil, errors.Join(ErrInvalidToken, errors.New("invalid token type"))
+	degraded := false
+	if err := s.checkRevocation(ctx, t, claims); err != nil {
+		if err := s.degraded.accept(ctx, claims, err); err != nil {
+			return nil, err
+		}
+		degraded = true
+		span.SetAttributes(attribute.Bool("degraded", true))
+	}
+
+	if err := verifyConfirmation(claims, sender); err != nil {
+		return nil, err
+	}
+	// Tokens that need a new login do not keep their session alive
+	if err := s.acrLevels.check(claims, requirement); err != nil {
+		return nil, err
+	}
+
+	// Exchanged tokens are short-lived and do not keep the session of their subject alive
+	if claims.Type == "access" && !degraded {
+		s.repo.ExtendTokenPairCacheExpiration(ctx, t, claims.Subject)
 	}
 
-	cached, err := s.repo.IsTokenCached(claims)
+	return &Authentication{JWTClaims: claims, Degraded: degraded}, nil
+}
+
+// validateAccessToken checks that a token is a valid access token, issued directly
+// or in a token exchange, that has not been revoked.
+func (s *AuthServiceImpl) validateAccessToken(ctx context.Context, t *tenant.Tenant, accessToken string) (*authjwt.JWTClaims, error) {
+	claims, err := s.parseAccessToken(ctx, t, accessToken)
 	if err != nil {
 		return nil, err
 	}
+	if err := s.checkRevocation(ctx, t, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (s *AuthServiceImpl) parseAccessToken(ctx context.Context, t *tenant.Tenant, accessToken string) (*authjwt.JWTClaims, error) {
+	claims, err := s.jwtService.ParseToken(ctx, t, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Type != "access" && claims.Type != "exchanged" {
+		return nil, errors.Join(ErrInvalidToken, ErrInvalidTokenType)
+	}
+	return claims, nil
+}
+
+func (s *AuthServiceImpl) checkRevocation(ctx context.Context, t *tenant.Tenant, claims *authjwt.JWTClaims) error {
+	cached, err := s.repo.IsTokenCached(ctx, t, claims)
+	if err != nil {
+		return err
+	}
 
 	if !cached {
-		return nil, errors.Join(ErrInvalidToken, errors.New("token not found"))
+		return errors.Join(ErrInvalidToken, ErrTokenRevoked)
 	}
+	return nil
+}
 
-	s.repo.ExtendTokenPairCacheExpiration(claims.UserID)
+func (s *AuthServiceImpl) Login(ctx context.Context, t *tenant.Tenant, grant *authjwt.Grant) (tokenPair *TokenPair, err error) {
+	ctx, span := startSpan(ctx, "AuthService.Login", t)
+	defer func() { tracing.End(span, err) }()
+	defer func() {
+		session := ""
+		if tokenPair != nil {
+			session = issuedUID(tokenPair.Access)
+		}
+		recordEvent(ctx, audit.TypeLogin, t, grant.Subject, session, err)
+	}()
+
+	if grant.AuthTime.IsZero() {
+		// The subject authenticated just now unless the caller reports an earlier authentication
+		authenticated := *grant
+		authenticated.AuthTime = time.Now()
+		grant = &authenticated
+	}
 
-	return claims, nil
+	tokenPair, err = s.issueTokenPair(ctx, t, grant)
+	if err != nil {
+		return nil, err
+	}
+	metrics.Logins.WithLabelValues(t.ID).Inc()
+	return tokenPair, nil
 }
 
-func (s *AuthServiceImpl) Login(userID uint) (*TokenPair, error) {
-	accessToken, err := s.jwtService.NewAccessToken(userID)
+// issueTokenPair issues a token pair for grant and makes it the session of the subject.
+func (s *AuthServiceImpl) issueTokenPair(ctx context.Context, t *tenant.Tenant, grant *authjwt.Grant) (*TokenPair, error) {
+	accessToken, err := s.jwtService.NewAccessToken(ctx, t, grant)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshToken, err := s.jwtService.NewRefreshToken(userID)
+	refreshToken, err := s.jwtService.NewRefreshToken(ctx, t, grant)
 	if err != nil {
 		return nil, err
 	}
@@ -67,7 +165,7 @@ func (s *AuthServiceImpl) Login(userID uint) (*TokenPair, error) {
 		Refresh: refreshToken,
 	}
 
-	err = s.repo.CacheTokenPair(tokenPair)
+	err = s.repo.CacheTokenPair(ctx, t, tokenPair)
 	if err != nil {
 		return nil, errors.Join(errors.New("failed to cache token pair"), err)
 	}
@@ -75,35 +173,83 @@ func (s *AuthServiceImpl) Login(userID uint) (*TokenPair, error) {
 	return tokenPair, nil
 }
 
-func (s *AuthServiceImpl) Refresh(refreshToken string) (*TokenPair, error) {
-	claims, err := s.jwtService.ParseToken(refreshToken)
+func (s *AuthServiceImpl) Refresh(ctx context.Context, t *tenant.Tenant, refreshToken string, sender *Sender) (tokenPair *TokenPair, err error) {
+	ctx, span := startSpan(ctx, "AuthService.Refresh", t)
+	defer func() { tracing.End(span, err) }()
+
+	var claims *authjwt.JWTClaims
+	defer func() { recordTokenEvent(ctx, audit.TypeRefresh, t, claims, err) }()
+
+	claims, err = s.jwtService.ParseToken(ctx, t, refreshToken)
 	if err != nil {
 		return nil, err
 	}
 
 	if claims.Type != "refresh" {
-		return nil, errors.Join(ErrInvalidToken, errors.New("invalid token type"))
+		return nil, errors.Join(ErrInvalidToken, ErrInvalidTokenType)
 	}
 
-	ok, err := s.repo.IsTokenCached(claims)
+	if err := verifyConfirmation(claims, sender); err != nil {
+		return nil, err
+	}
+
+	ok, err := s.repo.IsTokenCached(ctx, t, claims)
 	if err != nil {
 		return nil, err
 	}
 
 	if !ok {
-		return nil, errors.Join(ErrInvalidToken, errors.New("token not found"))
+		return nil, errors.Join(ErrInvalidToken, ErrTokenRevoked)
 	}
 
-	return s.Login(claims.UserID)
+	tokenPair, err = s.issueTokenPair(ctx, t, authjwt.GrantFromClaims(claims))
+	if err != nil {
+		return nil, err
+	}
+	metrics.Refreshes.WithLabelValues(t.ID).Inc()
+	return tokenPair, nil
 }
 
-func (s *AuthServiceImpl) Logout(accessToken string) error {
-	claims, err := s.jwtService.ParseToken(accessToken)
+func (s *AuthServiceImpl) Logout(ctx context.Context, t *tenant.Tenant, accessToken string, sender *Sender) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.Logout", t)
+	defer func() { tracing.End(span, err) }()
+
+	var claims *authjwt.JWTClaims
+	defer func() {
+		eventType := audit.TypeLogout
+		if claims != nil && claims.Type == "exchanged" {
+			eventType = audit.TypeRevocation
+		}
+		recordTokenEvent(ctx, eventType, t, claims, err)
+	}()
+
+	claims, err = s.jwtService.ParseToken(ctx, t, accessToken)
 	if err != nil {
 		return err
 	}
 
-	s.repo.DeleteTokenPair(claims.UserID)
+	// A stolen bound token cannot end the session of its owner either
+	if err = verifyConfirmation(claims, sender); err != nil {
+		return err
+	}
+
+	s.degraded.Deny(claims)
+
+	// Logging out with an exchanged token only revokes that token, not the session of its subject
+	if claims.Type == "exchanged" {
+		err = s.repo.DeleteExchangedToken(ctx, t, claims.UID)
+	} else {
+		err = s.repo.DeleteTokenPair(ctx, t, claims.Subject)
+	}
+	if err != nil {
+		// The session is still alive, the caller has to retry
+		return errors.Join(errors.New("failed to revoke session"), err)
+	}
+	metrics.Logouts.WithLabelValues(t.ID).Inc()
 
 	return nil
 }
+
+func startSpan(ctx context.Context, name string, t *tenant.Tenant) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("tenant", t.ID)))
+}
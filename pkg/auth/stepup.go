@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/auth/authjwt"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrStepUpRequired  = errors.New("step-up authentication required")
+	ErrInvalidAuthTime = errors.New("auth_time must not be in the future")
+)
+
+// AuthnRequirement is the authentication a resource server demands for an operation,
+// see RFC 9470. A token that does not meet it can only be replaced by logging in again.
+type AuthnRequirement struct {
+	ACRValues []string      // acceptable authentication context classes, empty if any is accepted
+	MaxAge    time.Duration // how long ago the subject may have authenticated, negative if any time is accepted
+}
+
+// StepUpError reports the requirement a token failed, so that the challenge can tell the client
+// what to ask the user for.
+type StepUpError struct {
+	Requirement *AuthnRequirement
+	Detail      string
+}
+
+func (e *StepUpError) Error() string {
+	return ErrStepUpRequired.Error() + ": " + e.Detail
+}
+
+func (e *StepUpError) Unwrap() error {
+	return ErrStepUpRequired
+}
+
+// challengeParams returns the acr_values and max_age parameters of the challenge.
+func (e *StepUpError) challengeParams() string {
+	var params string
+	if len(e.Requirement.ACRValues) > 0 {
+		params += fmt.Sprintf(", acr_values=%q", strings.Join(e.Requirement.ACRValues, " "))
+	}
+	if e.Requirement.MaxAge >= 0 {
+		params += fmt.Sprintf(", max_age=\"%d\"", int64(e.Requirement.MaxAge.Seconds()))
+	}
+	return params
+}
+
+// acrLevels orders authentication context classes from weakest to strongest.
+// A class satisfies requirements for itself and for every weaker class.
+type acrLevels []string
+
+func newACRLevels() acrLevels {
+	return viper.GetStringSlice("auth.step_up.acr_levels")
+}
+
+func (l acrLevels) satisfies(acr string, acceptable []string) bool {
+	if acr == "" {
+		return false
+	}
+	if slices.Contains(acceptable, acr) {
+		return true
+	}
+
+	level := slices.Index(l, acr)
+	if level < 0 {
+		return false
+	}
+	for _, value := range acceptable {
+		if required := slices.Index(l, value); required >= 0 && level >= required {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a StepUpError if the authentication the claims record does not meet req.
+func (l acrLevels) check(claims *authjwt.JWTClaims, req *AuthnRequirement) error {
+	if req == nil {
+		return nil
+	}
+	if len(req.ACRValues) > 0 && !l.satisfies(claims.ACR, req.ACRValues) {
+		return &StepUpError{Requirement: req, Detail: "authentication context class is insufficient"}
+	}
+	if req.MaxAge >= 0 && (claims.AuthTime == nil || time.Since(claims.AuthTime.Time) > req.MaxAge) {
+		return &StepUpError{Requirement: req, Detail: "authentication is too old"}
+	}
+	return nil
+}
+
+// checkAuthTime rejects authentication times before the epoch or in the future, allowing for
+// clock skew. The zero time stands for now.
+func checkAuthTime(authTime time.Time) error {
+	if authTime.IsZero() {
+		return nil
+	}
+	if authTime.Before(time.Unix(0, 0)) || authTime.After(time.Now().Add(time.Minute)) {
+		return ErrInvalidAuthTime
+	}
+	return nil
+}
+
+// parseAuthnRequirement reads the acr_values (space-delimited) and max_age (seconds) query
+// parameters. It returns nil when the request demands nothing in particular.
+func parseAuthnRequirement(r *http.Request) (*AuthnRequirement, error) {
+	query := r.URL.Query()
+	req := &AuthnRequirement{ACRValues: strings.Fields(query.Get("acr_values")), MaxAge: -1}
+
+	if value := query.Get("max_age"); value != "" {
+		seconds, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, errors.New("max_age must be a non-negative number of seconds")
+		}
+		req.MaxAge = time.Duration(seconds) * time.Second
+	}
+
+	if len(req.ACRValues) == 0 && req.MaxAge < 0 {
+		return nil, nil
+	}
+	return req, nil
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+// verificationCache remembers the UIDs of access tokens recently found valid in Redis, so that
+// hot tokens are not checked in Redis on every request. An entry is trusted for at most the
+// staleness bound. Revocations are published over Redis pub/sub as the cache key of the revoked
+// session or exchanged token, and every instance drops the entries validated before them.
+// While the subscription is down revocations may be missed, so the cache is not used at all.
+type verificationCache struct {
+	cache      *redis.Client
+	channel    string
+	maxEntries int
+	staleness  time.Duration
+
+	mu        sync.Mutex
+	live      bool                     // subscribed to revocations
+	entries   map[string]*list.Element // of *verifiedToken by token UID
+	recent    *list.List               // most recently used first
+	revoked   map[string]time.Time     // revocation time by cache key
+	lastPrune time.Time
+
+	pubsub *redis.PubSub
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type verifiedToken struct {
+	uid       string
+	key       string // cache key whose deletion revokes the token
+	checkedAt time.Time
+}
+
+// newVerificationCache returns nil when the local cache is disabled.
+func newVerificationCache(cache *redis.Client) *verificationCache {
+	if !viper.GetBool("cache.local.enabled") {
+		return nil
+	}
+
+	c := &verificationCache{
+		cache:      cache,
+		channel:    config.StringOrDefault("cache.local.channel", "jwt-revocations"),
+		maxEntries: config.IntOrDefault("cache.local.max_entries", 10000),
+		staleness:  config.DurationOrDefault("cache.local.staleness", 5*time.Second),
+		entries:    map[string]*list.Element{},
+		recent:     list.New(),
+		revoked:    map[string]time.Time{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	c.pubsub = cache.Subscribe(context.Background(), c.channel)
+	go c.listen()
+	return c
+}
+
+// Get reports whether the token was found valid within the staleness bound and not revoked since.
+func (c *verificationCache) Get(uid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[uid]
+	if !ok || !c.live {
+		metrics.VerificationCache.WithLabelValues(metrics.CacheMiss).Inc()
+		return false
+	}
+
+	entry := element.Value.(*verifiedToken)
+	if time.Since(entry.checkedAt) > c.staleness || c.revoked[entry.key].After(entry.checkedAt) {
+		c.remove(element)
+		metrics.VerificationCache.WithLabelValues(metrics.CacheMiss).Inc()
+		return false
+	}
+
+	c.recent.MoveToFront(element)
+	metrics.VerificationCache.WithLabelValues(metrics.CacheHit).Inc()
+	return true
+}
+
+// Add records that the token was found valid in Redis by a check started at checkedAt.
+// Taking the time before the check keeps a revocation that races with it from being lost.
+func (c *verificationCache) Add(uid, key string, checkedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.live || c.revoked[key].After(checkedAt) {
+		return
+	}
+	if element, ok := c.entries[uid]; ok {
+		element.Value.(*verifiedToken).checkedAt = checkedAt
+		c.recent.MoveToFront(element)
+		return
+	}
+
+	c.entries[uid] = c.recent.PushFront(&verifiedToken{uid: uid, key: key, checkedAt: checkedAt})
+	if c.recent.Len() > c.maxEntries {
+		c.remove(c.recent.Back())
+	}
+}
+
+// Revoke drops the tokens revoked by the deletion of key on this and every other instance.
+func (c *verificationCache) Revoke(ctx context.Context, key string) {
+	c.invalidate(key)
+	if err := c.cache.Publish(ctx, c.channel, key).Err(); err != nil {
+		// Other instances honor the revoked tokens until their entries go stale
+		slog.WarnContext(ctx, "Failed to publish revocation", slog.Any("error", err))
+	}
+}
+
+func (c *verificationCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.revoked[key] = now
+	metrics.VerificationCacheRevocations.Inc()
+
+	// Entries checked more than the staleness bound ago are not trusted anyway
+	if now.Sub(c.lastPrune) > c.staleness {
+		for revokedKey, revokedAt := range c.revoked {
+			if now.Sub(revokedAt) > c.staleness {
+				delete(c.revoked, revokedKey)
+			}
+		}
+		c.lastPrune = now
+	}
+}
+
+func (c *verificationCache) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*verifiedToken).uid)
+}
+
+// setLive enables the cache once subscribed. Revocations may have been missed before,
+// so the entries are dropped either way.
+func (c *verificationCache) setLive(live bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if live != c.live {
+		slog.Info("Local verification cache subscription changed", slog.Bool("live", live))
+	}
+	c.live = live
+	c.entries = map[string]*list.Element{}
+	c.recent.Init()
+}
+
+// listen applies revocations published by every instance, including this one. The
+// subscription is restored by the client after connection errors.
+func (c *verificationCache) listen() {
+	defer close(c.done)
+
+	for {
+		msg, err := c.pubsub.Receive(context.Background())
+		if err != nil {
+			if errors.Is(err, redis.ErrClosed) {
+				return
+			}
+			if c.isLive() {
+				slog.Warn("Lost revocation subscription", slog.Any("error", err))
+				c.setLive(false)
+			}
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			c.setLive(msg.Kind == "subscribe")
+		case *redis.Message:
+			c.invalidate(msg.Payload)
+		}
+	}
+}
+
+func (c *verificationCache) isLive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.live
+}
+
+func (c *verificationCache) Close() error {
+	close(c.stop)
+	err := c.pubsub.Close()
+	<-c.done
+	return err
+}
@@ -0,0 +1,122 @@
+package breaker
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Breaker stops calls to a dependency after a number of consecutive failures. Once open,
+// calls fail with ErrOpen until the cooldown has passed, then a single probe is let through:
+// its success closes the breaker, its failure opens it again.
+type Breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func New(name string, threshold int, cooldown time.Duration) *Breaker {
+	b := &Breaker{name: name, threshold: max(threshold, 1), cooldown: cooldown}
+	metrics.CircuitBreakerState.WithLabelValues(name).Set(float64(Closed))
+	return b
+}
+
+// Allow reports whether a call may proceed. Every allowed call must be followed by Success,
+// Failure or Ignore.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrOpen
+		}
+		b.transition(HalfOpen)
+		b.probing = true
+		return nil
+	case HalfOpen:
+		if b.probing {
+			return ErrOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != Closed {
+		b.transition(Closed)
+	}
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.transition(Open)
+	}
+}
+
+// Ignore releases a call whose outcome says nothing about the health of the dependency,
+// such as one cancelled by its caller.
+func (b *Breaker) Ignore() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *Breaker) transition(state State) {
+	slog.Warn("Circuit breaker changed state", slog.String("breaker", b.name), slog.String("from", b.state.String()), slog.String("to", state.String()))
+	b.state = state
+	metrics.CircuitBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
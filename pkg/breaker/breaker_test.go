@@ -0,0 +1,54 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := New("test", 3, time.Hour)
+
+	for range 2 {
+		assert.NoError(t, b.Allow())
+		b.Failure()
+	}
+	// A success resets the count of consecutive failures
+	assert.NoError(t, b.Allow())
+	b.Success()
+	for range 3 {
+		assert.NoError(t, b.Allow())
+		b.Failure()
+	}
+
+	assert.Equal(t, Open, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+	assert.Equal(t, float64(Open), testutil.ToFloat64(metrics.CircuitBreakerState.WithLabelValues("test")))
+}
+
+func TestBreakerProbesAfterCooldown(t *testing.T) {
+	b := New("probe", 1, 10*time.Millisecond)
+	assert.NoError(t, b.Allow())
+	b.Failure()
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, b.Allow())
+	assert.Equal(t, HalfOpen, b.State())
+	// Only a single probe is in flight
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+
+	// A failed probe opens the breaker for another cooldown
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, b.Allow())
+	b.Success()
+	assert.Equal(t, Closed, b.State())
+	assert.NoError(t, b.Allow())
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/breaker"
+	"github.com/redis/go-redis/v9"
+)
+
+// BreakerHook fails commands with breaker.ErrOpen while b is open and reports the outcome
+// of the other commands to it. Missing keys and error replies count as successes since
+// Redis answered them.
+func BreakerHook(b *breaker.Breaker) redis.Hook {
+	return breakerHook{breaker: b}
+}
+
+type breakerHook struct {
+	breaker *breaker.Breaker
+}
+
+func (h breakerHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h breakerHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.breaker.Allow(); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		err := next(ctx, cmd)
+		h.record(err)
+		return err
+	}
+}
+
+func (h breakerHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := h.breaker.Allow(); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		err := next(ctx, cmds)
+		h.record(err)
+		return err
+	}
+}
+
+func (h breakerHook) record(err error) {
+	var reply redis.Error
+	switch {
+	case err == nil, errors.Is(err, redis.Nil), errors.As(err, &reply):
+		h.breaker.Success()
+	case errors.Is(err, context.Canceled):
+		h.breaker.Ignore()
+	default:
+		h.breaker.Failure()
+	}
+}
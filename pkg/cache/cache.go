@@ -2,14 +2,41 @@ package cache
 
 import (
 	"fmt"
+	"log/slog"
 
+	"github.com/GregoryKogan/jwt-microservice/pkg/breaker"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"github.com/spf13/viper"
 )
 
+// InitCacheConnection connects to Redis through hooks that, from the outside in, record
+// metrics and traces, retry idempotent commands and apply the circuit breaker to every attempt.
 func InitCacheConnection() *redis.Client {
 	addr := fmt.Sprintf("%s:%d", viper.GetString("cache.host"), viper.GetInt("cache.port"))
-	return redis.NewClient(&redis.Options{
+	client := redis.NewClient(&redis.Options{
 		Addr: addr,
+		// Otherwise deadlines of the context are ignored once a command is sent
+		ContextTimeoutEnabled: true,
+		// The client would retry every command, RetryHook only retries idempotent ones
+		MaxRetries: -1,
 	})
+	client.AddHook(metrics.RedisHook())
+	if err := redisotel.InstrumentTracing(client); err != nil {
+		slog.Error("Failed to instrument cache connection for tracing", slog.Any("error", err))
+	}
+	if attempts := viper.GetInt("cache.retry.max_attempts"); attempts > 1 {
+		client.AddHook(RetryHook(attempts,
+			viper.GetDuration("cache.retry.min_backoff"),
+			viper.GetDuration("cache.retry.max_backoff"),
+		))
+	}
+	if viper.GetBool("cache.circuit_breaker.enabled") {
+		client.AddHook(BreakerHook(breaker.New("cache",
+			viper.GetInt("cache.circuit_breaker.failure_threshold"),
+			viper.GetDuration("cache.circuit_breaker.open_timeout"),
+		)))
+	}
+	return client
 }
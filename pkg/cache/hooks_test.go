@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/breaker"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyHook fails the first commands with a connection error and answers the others itself.
+type flakyHook struct {
+	failures int
+	calls    int
+}
+
+func (h *flakyHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *flakyHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.calls++
+		if h.calls <= h.failures {
+			cmd.SetErr(io.EOF)
+			return io.EOF
+		}
+		if get, ok := cmd.(*redis.StringCmd); ok {
+			get.SetVal("value")
+		}
+		if setnx, ok := cmd.(*redis.BoolCmd); ok {
+			setnx.SetVal(true)
+		}
+		return nil
+	}
+}
+
+func (h *flakyHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func newClient(hooks ...redis.Hook) *redis.Client {
+	// Nothing listens on port 1
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	for _, hook := range hooks {
+		client.AddHook(hook)
+	}
+	return client
+}
+
+func TestRetryHook(t *testing.T) {
+	flaky := &flakyHook{failures: 2}
+	client := newClient(RetryHook(3, time.Millisecond, 2*time.Millisecond), flaky)
+	defer client.Close()
+
+	retries := testutil.ToFloat64(metrics.RedisRetries.WithLabelValues("get"))
+	value, err := client.Get(context.Background(), "key").Result()
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, 3, flaky.calls)
+	assert.Equal(t, retries+2, testutil.ToFloat64(metrics.RedisRetries.WithLabelValues("get")))
+
+	// Attempts are bounded
+	flaky.calls, flaky.failures = 0, 5
+	assert.ErrorIs(t, client.Get(context.Background(), "key").Err(), io.EOF)
+	assert.Equal(t, 3, flaky.calls)
+
+	// Commands that are not idempotent are sent once
+	flaky.calls, flaky.failures = 0, 1
+	assert.ErrorIs(t, client.SetNX(context.Background(), "key", 1, time.Minute).Err(), io.EOF)
+	assert.Equal(t, 1, flaky.calls)
+
+	// Contexts that are done are not retried
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flaky.calls, flaky.failures = 0, 1
+	assert.Error(t, client.Get(ctx, "key").Err())
+	assert.Equal(t, 1, flaky.calls)
+}
+
+func TestBackoff(t *testing.T) {
+	hook := RetryHook(5, 10*time.Millisecond, 25*time.Millisecond).(retryHook)
+	for range 100 {
+		assert.Less(t, hook.backoff(1), 10*time.Millisecond)
+		assert.Less(t, hook.backoff(4), 25*time.Millisecond)
+	}
+}
+
+func TestBreakerHook(t *testing.T) {
+	b := breaker.New("cache-test", 2, time.Hour)
+	client := newClient(BreakerHook(b))
+	defer client.Close()
+
+	// Missing keys and error replies are answers from Redis
+	assert.False(t, retryable(context.Background(), redis.Nil))
+	var opErr error = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	assert.True(t, retryable(context.Background(), opErr))
+
+	for range 2 {
+		err := client.Get(context.Background(), "key").Err()
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, breaker.ErrOpen)
+	}
+	assert.Equal(t, breaker.Open, b.State())
+	assert.ErrorIs(t, client.Get(context.Background(), "key").Err(), breaker.ErrOpen)
+
+	_, err := client.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Expire(context.Background(), "key", time.Minute)
+		return nil
+	})
+	assert.ErrorIs(t, err, breaker.ErrOpen)
+}
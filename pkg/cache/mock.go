@@ -66,7 +66,8 @@ func setupCache(pool *dockertest.Pool) (*redis.Client, *dockertest.Resource) {
 	var cache *redis.Client
 	err = pool.Retry(func() error {
 		cache = redis.NewClient(&redis.Options{
-			Addr: fmt.Sprintf("localhost:%s", redisResource.GetPort("6379/tcp")),
+			Addr:                  fmt.Sprintf("localhost:%s", redisResource.GetPort("6379/tcp")),
+			ContextTimeoutEnabled: true,
 		})
 		_, err := cache.Ping(context.Background()).Result()
 		return err
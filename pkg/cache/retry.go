@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/breaker"
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+// idempotent lists the commands that leave Redis in the same state when sent twice, so they
+// may be retried after a failure whose outcome is unknown.
+var idempotent = map[string]bool{
+	"get":    true,
+	"set":    true,
+	"del":    true,
+	"expire": true,
+	"ttl":    true,
+	"exists": true,
+	"scan":   true,
+	"ping":   true,
+}
+
+// RetryHook sends failed idempotent commands, and pipelines of them, again up to a total of
+// attempts. Retries wait a random delay below an exponentially growing ceiling, from
+// minBackoff up to maxBackoff, so that instances recovering together do not retry in lockstep.
+// Missing keys, error replies, an open circuit breaker and expired contexts are not retried.
+func RetryHook(attempts int, minBackoff, maxBackoff time.Duration) redis.Hook {
+	return retryHook{attempts: attempts, minBackoff: minBackoff, maxBackoff: maxBackoff}
+}
+
+type retryHook struct {
+	attempts   int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func (h retryHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h retryHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !isIdempotent(cmd) {
+			return next(ctx, cmd)
+		}
+		return h.retry(ctx, cmd.Name(), []redis.Cmder{cmd}, func() error { return next(ctx, cmd) })
+	}
+}
+
+func (h retryHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if !isIdempotent(cmd) {
+				return next(ctx, cmds)
+			}
+		}
+		return h.retry(ctx, "pipeline", cmds, func() error { return next(ctx, cmds) })
+	}
+}
+
+func (h retryHook) retry(ctx context.Context, name string, cmds []redis.Cmder, process func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := process()
+		if attempt >= h.attempts || !retryable(ctx, err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(h.backoff(attempt)):
+		}
+		metrics.RedisRetries.WithLabelValues(name).Inc()
+		for _, cmd := range cmds {
+			cmd.SetErr(nil)
+		}
+	}
+}
+
+// isIdempotent excludes SET with the NX option, which claims DPoP proofs: a retry after
+// a lost reply would report a fresh proof as replayed.
+func isIdempotent(cmd redis.Cmder) bool {
+	if !idempotent[cmd.Name()] {
+		return false
+	}
+	// Options follow the key and the value
+	if args := cmd.Args(); cmd.Name() == "set" && len(args) > 3 {
+		for _, arg := range args[3:] {
+			if option, ok := arg.(string); ok && strings.EqualFold(option, "nx") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// backoff draws the delay before the retry following attempt with full jitter.
+func (h retryHook) backoff(attempt int) time.Duration {
+	ceiling := min(h.minBackoff<<(attempt-1), h.maxBackoff)
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
+
+func retryable(ctx context.Context, err error) bool {
+	var reply redis.Error
+	return err != nil &&
+		ctx.Err() == nil &&
+		!errors.Is(err, redis.Nil) &&
+		!errors.Is(err, breaker.ErrOpen) &&
+		!errors.As(err, &reply)
+}
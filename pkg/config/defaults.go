@@ -0,0 +1,31 @@
+package config
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// StringOrDefault returns the string at key, or fallback when it is unset or empty.
+func StringOrDefault(key, fallback string) string {
+	if value := viper.GetString(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// DurationOrDefault returns the duration at key, or fallback when it is unset or not positive.
+func DurationOrDefault(key string, fallback time.Duration) time.Duration {
+	if value := viper.GetDuration(key); value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// IntOrDefault returns the integer at key, or fallback when it is unset or not positive.
+func IntOrDefault(key string, fallback int) int {
+	if value := viper.GetInt(key); value > 0 {
+		return value
+	}
+	return fallback
+}
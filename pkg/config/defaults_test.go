@@ -0,0 +1,32 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaults(t *testing.T) {
+	viper.Reset()
+	viper.Set("name", "issuer")
+	viper.Set("empty", "")
+	viper.Set("timeout", "2s")
+	viper.Set("negative", "-1s")
+	viper.Set("size", 10)
+	viper.Set("zero", 0)
+
+	assert.Equal(t, "issuer", config.StringOrDefault("name", "fallback"))
+	assert.Equal(t, "fallback", config.StringOrDefault("empty", "fallback"))
+	assert.Equal(t, "fallback", config.StringOrDefault("missing", "fallback"))
+
+	assert.Equal(t, 2*time.Second, config.DurationOrDefault("timeout", time.Minute))
+	assert.Equal(t, time.Minute, config.DurationOrDefault("negative", time.Minute))
+	assert.Equal(t, time.Minute, config.DurationOrDefault("missing", time.Minute))
+
+	assert.Equal(t, 10, config.IntOrDefault("size", 5))
+	assert.Equal(t, 5, config.IntOrDefault("zero", 5))
+	assert.Equal(t, 5, config.IntOrDefault("missing", 5))
+}
@@ -0,0 +1,158 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+var ErrMissingSigningKey = errors.New("missing signing key")
+
+// Check is a dependency the service needs to serve requests.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+type HealthHandler interface {
+	Livez(w http.ResponseWriter, r *http.Request)
+	Readyz(w http.ResponseWriter, r *http.Request)
+}
+
+type HealthHandlerImpl struct {
+	checks  []Check
+	timeout time.Duration
+}
+
+func NewHealthHandler(checks ...Check) HealthHandler {
+	timeout := viper.GetDuration("health.timeout")
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &HealthHandlerImpl{checks: checks, timeout: timeout}
+}
+
+// Livez reports that the process is up and serving HTTP. It does not check dependencies:
+// restarting the service would not bring back Redis.
+func (h *HealthHandlerImpl) Livez(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+	writeReport(w, r, &Report{Status: StatusOK})
+}
+
+// Readyz runs every check concurrently, each bounded by the health timeout, and answers 503
+// with the failed checks when the service cannot serve requests. Load balancers should stop
+// routing to an instance that is not ready.
+func (h *HealthHandlerImpl) Readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		problem.MethodNotAllowed(w, r)
+		return
+	}
+
+	report := h.runChecks(r.Context())
+	if report.Status != StatusOK {
+		slog.WarnContext(r.Context(), "Readiness check failed", slog.Any("checks", report.Checks))
+	}
+	writeReport(w, r, report)
+}
+
+func (h *HealthHandlerImpl) runChecks(ctx context.Context) *Report {
+	report := &Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(h.checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := h.runCheck(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusFail
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+func (h *HealthHandlerImpl) runCheck(ctx context.Context, check Check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Run(ctx)
+	result := CheckResult{Status: StatusOK, Duration: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func writeReport(w http.ResponseWriter, r *http.Request, report *Report) {
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode health report", "error", err)
+	}
+}
+
+// CacheCheck pings Redis.
+func CacheCheck(cache *redis.Client) Check {
+	return Check{Name: "cache", Run: func(ctx context.Context) error {
+		return cache.Ping(ctx).Err()
+	}}
+}
+
+// SigningKeyCheck confirms that every tenant has a signing key, which is empty when its secret failed to load.
+func SigningKeyCheck(tenants []*tenant.Tenant) Check {
+	return Check{Name: "signing_key", Run: func(ctx context.Context) error {
+		for _, t := range tenants {
+			if len(t.Key) == 0 {
+				return fmt.Errorf("%w for tenant %s", ErrMissingSigningKey, t.ID)
+			}
+		}
+		return nil
+	}}
+}
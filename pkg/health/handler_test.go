@@ -0,0 +1,99 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func passing(name string) Check {
+	return Check{Name: name, Run: func(ctx context.Context) error { return nil }}
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder) Report {
+	var report Report
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+	return report
+}
+
+func TestLivez(t *testing.T) {
+	failing := Check{Name: "cache", Run: func(ctx context.Context) error { return errors.New("cache unavailable") }}
+	handler := NewHealthHandler(failing)
+
+	w := httptest.NewRecorder()
+	handler.Livez(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, Report{Status: StatusOK}, decode(t, w))
+
+	w = httptest.NewRecorder()
+	handler.Livez(w, httptest.NewRequest(http.MethodPost, "/livez", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestReadyz(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewHealthHandler(passing("cache"), passing("signing_key")).Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	report := decode(t, w)
+	assert.Equal(t, StatusOK, report.Status)
+	assert.Len(t, report.Checks, 2)
+
+	failing := Check{Name: "cache", Run: func(ctx context.Context) error { return errors.New("cache unavailable") }}
+	w = httptest.NewRecorder()
+	NewHealthHandler(failing, passing("signing_key")).Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	report = decode(t, w)
+	assert.Equal(t, StatusFail, report.Status)
+	assert.Equal(t, StatusFail, report.Checks["cache"].Status)
+	assert.Equal(t, "cache unavailable", report.Checks["cache"].Error)
+	assert.Equal(t, StatusOK, report.Checks["signing_key"].Status)
+}
+
+func TestReadyzHead(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewHealthHandler(passing("cache")).Readyz(w, httptest.NewRequest(http.MethodHead, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestReadyzTimeout(t *testing.T) {
+	hanging := Check{Name: "cache", Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	handler := &HealthHandlerImpl{checks: []Check{hanging}, timeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, context.DeadlineExceeded.Error(), decode(t, w).Checks["cache"].Error)
+}
+
+func TestCacheCheck(t *testing.T) {
+	// Nothing listens on port 1
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+	assert.Error(t, CacheCheck(client).Run(context.Background()))
+}
+
+func TestSigningKeyCheck(t *testing.T) {
+	check := SigningKeyCheck([]*tenant.Tenant{{ID: "default", Key: []byte("secret")}})
+	assert.NoError(t, check.Run(context.Background()))
+
+	check = SigningKeyCheck([]*tenant.Tenant{{ID: "default", Key: []byte("secret")}, {ID: "acme"}})
+	err := check.Run(context.Background())
+	assert.ErrorIs(t, err, ErrMissingSigningKey)
+	assert.Contains(t, err.Error(), "acme")
+}
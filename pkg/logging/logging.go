@@ -1,8 +1,11 @@
 package logging
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"syscall"
 
 	"github.com/spf13/viper"
 )
@@ -18,7 +21,7 @@ func Init() {
 		handler = slog.NewJSONHandler(os.Stdout, opts)
 	}
 
-	logger := slog.New(handler)
+	logger := slog.New(contextHandler{handler})
 	slog.SetDefault(logger)
 
 	slog.Info("Logging initialized", slog.String("level", opts.Level.Level().String()))
@@ -39,3 +42,11 @@ func getLogLevel() slog.Level {
 		return slog.LevelInfo
 	}
 }
+
+// Sync flushes log output that is still buffered by the operating system.
+// It is called on shutdown so that the last log lines are not lost.
+func Sync() {
+	if err := os.Stdout.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTSUP) {
+		fmt.Fprintf(os.Stderr, "Failed to flush logs: %v\n", err)
+	}
+}
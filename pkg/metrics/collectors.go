@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SessionCounter counts the active sessions of a tenant.
+type SessionCounter interface {
+	CountSessions(ctx context.Context, t *tenant.Tenant) (int64, error)
+}
+
+var sessionsDesc = prometheus.NewDesc("auth_active_sessions", "Sessions that have not been logged out or expired.", []string{"tenant"}, nil)
+
+// sessionCollector reports active sessions per tenant. Counting scans the cache,
+// so counts are refreshed on scrape at most once per interval.
+type sessionCollector struct {
+	counter  SessionCounter
+	tenants  []*tenant.Tenant
+	interval time.Duration
+
+	mu        sync.Mutex
+	counts    map[string]int64
+	refreshed time.Time
+}
+
+func NewSessionCollector(counter SessionCounter, tenants []*tenant.Tenant, interval time.Duration) prometheus.Collector {
+	return &sessionCollector{counter: counter, tenants: tenants, interval: interval, counts: map[string]int64{}}
+}
+
+func (c *sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+}
+
+func (c *sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.refreshed) >= c.interval {
+		for _, t := range c.tenants {
+			count, err := c.counter.CountSessions(context.Background(), t)
+			if err != nil {
+				// Keep reporting the last count rather than a misleading zero
+				slog.Warn("Failed to count active sessions", slog.String("tenant", t.ID), slog.Any("error", err))
+				continue
+			}
+			c.counts[t.ID] = count
+		}
+		c.refreshed = time.Now()
+	}
+
+	for id, count := range c.counts {
+		ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(count), id)
+	}
+}
+
+var (
+	signingKeysDesc    = prometheus.NewDesc("auth_signing_keys", "Signing keys loaded for a tenant.", []string{"tenant", "algorithm"}, nil)
+	signingKeyBitsDesc = prometheus.NewDesc("auth_signing_key_bits", "Size of the active signing key of a tenant.", []string{"tenant"}, nil)
+)
+
+// keyRingCollector reports the signing keys of every tenant. Each tenant signs with a single HS256 key.
+type keyRingCollector struct {
+	tenants []*tenant.Tenant
+}
+
+func NewKeyRingCollector(tenants []*tenant.Tenant) prometheus.Collector {
+	return &keyRingCollector{tenants: tenants}
+}
+
+func (c *keyRingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- signingKeysDesc
+	ch <- signingKeyBitsDesc
+}
+
+func (c *keyRingCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range c.tenants {
+		keys := 0.0
+		if len(t.Key) > 0 {
+			keys = 1
+		}
+		ch <- prometheus.MustNewConstMetric(signingKeysDesc, prometheus.GaugeValue, keys, t.ID, "HS256")
+		ch <- prometheus.MustNewConstMetric(signingKeyBitsDesc, prometheus.GaugeValue, float64(len(t.Key)*8), t.ID)
+	}
+}
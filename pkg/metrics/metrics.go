@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every metric of the service. It is separate from the default registry
+// so that dependencies cannot add metrics behind our back.
+var Registry = prometheus.NewRegistry()
+
+// Token operations are fast, so the buckets focus on the millisecond range.
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+var factory = promauto.With(Registry)
+
+var (
+	httpRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by route and status.",
+		Buckets: latencyBuckets,
+	}, []string{"route", "status"})
+
+	Logins = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_logins_total",
+		Help: "Token pairs issued by logins.",
+	}, []string{"tenant"})
+	Refreshes = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_refreshes_total",
+		Help: "Token pairs rotated by refreshes.",
+	}, []string{"tenant"})
+	Logouts = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_logouts_total",
+		Help: "Sessions and exchanged tokens revoked by logouts.",
+	}, []string{"tenant"})
+	// Failures is labelled with the reason codes of auth.ReasonOf.
+	Failures = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_failures_total",
+		Help: "Failed auth requests by reason.",
+	}, []string{"reason"})
+
+	// SessionExtensions is labelled with the Extension* results.
+	SessionExtensions = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_session_extensions_total",
+		Help: "Sliding session expiration extensions by result.",
+	}, []string{"result"})
+	SessionExtensionQueue = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "auth_session_extension_queue_depth",
+		Help: "Sessions waiting for their expiration to be extended.",
+	})
+
+	// VerificationCache is labelled with CacheHit or CacheMiss.
+	VerificationCache = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_verification_cache_requests_total",
+		Help: "Lookups of access tokens in the local verification cache by result.",
+	}, []string{"result"})
+	VerificationCacheRevocations = factory.NewCounter(prometheus.CounterOpts{
+		Name: "auth_verification_cache_revocations_total",
+		Help: "Revocations applied to the local verification cache, including those of other instances.",
+	})
+
+	// CircuitBreakerState holds the breaker.State of every circuit breaker.
+	CircuitBreakerState = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "State of circuit breakers: 0 closed, 1 open, 2 half-open.",
+	}, []string{"breaker"})
+	// DegradedDecisions is labelled with the Degraded* results.
+	DegradedDecisions = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_degraded_decisions_total",
+		Help: "Access tokens checked without Redis while its circuit breaker is open, by result.",
+	}, []string{"result"})
+
+	// RateLimitDecisions is labelled with RateLimitAllowed or RateLimitLimited.
+	RateLimitDecisions = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_decisions_total",
+		Help: "Requests checked against rate limit rules by route, key and result.",
+	}, []string{"route", "key", "result"})
+	RateLimitFallbacks = factory.NewCounter(prometheus.CounterOpts{
+		Name: "rate_limit_local_fallbacks_total",
+		Help: "Rate limit checks decided by the local limiter because Redis was unavailable.",
+	})
+
+	// AuditEvents is labelled with AuditQueued or AuditDropped.
+	AuditEvents = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "audit_events_total",
+		Help: "Audit events queued for the sinks or dropped because the queue was full.",
+	}, []string{"result"})
+	AuditSinkErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "audit_sink_errors_total",
+		Help: "Audit events that a sink failed to write.",
+	}, []string{"sink"})
+)
+
+// Results of recording audit events.
+const (
+	AuditQueued  = "queued"
+	AuditDropped = "dropped"
+)
+
+// Results of rate limit checks.
+const (
+	RateLimitAllowed = "allowed"
+	RateLimitLimited = "limited"
+)
+
+// Results of degraded verification.
+const (
+	DegradedAccepted = "accepted" // signature-valid and unexpired
+	DegradedRevoked  = "revoked"  // on the local denylist
+	DegradedTooOld   = "too_old"  // older than the maximum token age
+)
+
+// Results of verification cache lookups.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// Results of session extensions.
+const (
+	ExtensionWritten   = "written"   // sent to Redis
+	ExtensionCoalesced = "coalesced" // merged into an extension already queued for the session
+	ExtensionDropped   = "dropped"   // not queued because the queue was full
+	ExtensionFailed    = "failed"    // sent to Redis, which failed
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Instrument counts the requests of a route and observes their latency.
+// Routes are named by the caller rather than taken from the path, which may contain tenant IDs.
+func Instrument(route string) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := middleware.NewStatusRecorder(w)
+
+			next.ServeHTTP(recorder, r)
+
+			status := strconv.Itoa(recorder.Status())
+			httpRequests.WithLabelValues(route, method(r.Method), status).Inc()
+			httpDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// method bounds the label values of the method, which forward auth accepts verbatim from clients.
+func method(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return m
+	default:
+		return "OTHER"
+	}
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrument(t *testing.T) {
+	handler := Instrument("login")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	for _, method := range []string{http.MethodPost, "PROPFIND"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/t/acme/login", nil))
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(httpRequests.WithLabelValues("login", http.MethodPost, "401")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(httpRequests.WithLabelValues("login", "OTHER", "401")))
+	assert.Equal(t, 1, testutil.CollectAndCount(httpDuration, "http_request_duration_seconds"))
+}
+
+func TestHandler(t *testing.T) {
+	Logins.WithLabelValues(tenant.DefaultID).Inc()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `auth_logins_total{tenant="default"}`)
+	assert.Contains(t, w.Body.String(), "go_goroutines")
+}
+
+func TestRedisHook(t *testing.T) {
+	// Nothing listens on port 1, so every command fails to dial
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: time.Second})
+	client.AddHook(RedisHook())
+	defer client.Close()
+
+	before := testutil.ToFloat64(redisErrors.WithLabelValues("get"))
+	require.Error(t, client.Get(context.Background(), "key").Err())
+	assert.Equal(t, before+1, testutil.ToFloat64(redisErrors.WithLabelValues("get")))
+
+	_, err := client.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Expire(context.Background(), "key", time.Minute)
+		return nil
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(redisErrors.WithLabelValues("pipeline"))+testutil.ToFloat64(redisErrors.WithLabelValues("expire")))
+
+	assert.False(t, isRedisError(redis.Nil))
+}
+
+type fakeSessionCounter struct {
+	counts map[string]int64
+	err    error
+	calls  int
+}
+
+func (c *fakeSessionCounter) CountSessions(ctx context.Context, t *tenant.Tenant) (int64, error) {
+	c.calls++
+	return c.counts[t.ID], c.err
+}
+
+func TestSessionCollector(t *testing.T) {
+	counter := &fakeSessionCounter{counts: map[string]int64{"default": 3, "acme": 1}}
+	tenants := []*tenant.Tenant{{ID: "acme"}, {ID: "default"}}
+	collector := NewSessionCollector(counter, tenants, time.Minute)
+
+	expected := `
+# HELP auth_active_sessions Sessions that have not been logged out or expired.
+# TYPE auth_active_sessions gauge
+auth_active_sessions{tenant="acme"} 1
+auth_active_sessions{tenant="default"} 3
+`
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+
+	// Counts are cached within the interval and kept when counting fails
+	counter.counts["default"] = 5
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+	assert.Equal(t, 2, counter.calls)
+
+	collector.(*sessionCollector).refreshed = time.Time{}
+	counter.err = errors.New("cache unavailable")
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+}
+
+func TestKeyRingCollector(t *testing.T) {
+	collector := NewKeyRingCollector([]*tenant.Tenant{{ID: "default", Key: make([]byte, 32)}, {ID: "acme"}})
+
+	expected := `
+# HELP auth_signing_key_bits Size of the active signing key of a tenant.
+# TYPE auth_signing_key_bits gauge
+auth_signing_key_bits{tenant="acme"} 0
+auth_signing_key_bits{tenant="default"} 256
+# HELP auth_signing_keys Signing keys loaded for a tenant.
+# TYPE auth_signing_keys gauge
+auth_signing_keys{algorithm="HS256",tenant="acme"} 0
+auth_signing_keys{algorithm="HS256",tenant="default"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+}
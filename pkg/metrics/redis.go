@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redis_command_duration_seconds",
+		Help:    "Latency of Redis commands. Pipelines are observed as a whole.",
+		Buckets: latencyBuckets,
+	}, []string{"command"})
+	redisErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_command_errors_total",
+		Help: "Failed Redis commands. Missing keys are not errors.",
+	}, []string{"command"})
+	// RedisRetries counts commands sent again after a failure, pipelines as "pipeline".
+	RedisRetries = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_command_retries_total",
+		Help: "Redis commands retried after a failure.",
+	}, []string{"command"})
+)
+
+// RedisHook instruments the commands of a go-redis client.
+func RedisHook() redis.Hook {
+	return redisHook{}
+}
+
+type redisHook struct{}
+
+func (redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			redisErrors.WithLabelValues("dial").Inc()
+		}
+		return conn, err
+	}
+}
+
+func (redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		redisDuration.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+		if isRedisError(err) {
+			redisErrors.WithLabelValues(cmd.Name()).Inc()
+		}
+		return err
+	}
+}
+
+func (redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		redisDuration.WithLabelValues("pipeline").Observe(time.Since(start).Seconds())
+		failed := false
+		for _, cmd := range cmds {
+			if isRedisError(cmd.Err()) {
+				redisErrors.WithLabelValues(cmd.Name()).Inc()
+				failed = true
+			}
+		}
+		// Connection errors fail the pipeline without being set on its commands
+		if !failed && isRedisError(err) {
+			redisErrors.WithLabelValues("pipeline").Inc()
+		}
+		return err
+	}
+}
+
+func isRedisError(err error) bool {
+	return err != nil && !errors.Is(err, redis.Nil)
+}
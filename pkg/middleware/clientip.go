@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// ClientIP stores the address of the client in the request context. Behind trusted proxies the
+// address is taken from X-Forwarded-For, walking back from the nearest hop to the first address
+// that is not a trusted proxy; the header cannot be spoofed by clients connecting directly.
+func ClientIP(trustedProxies []netip.Prefix) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			addr := addrPort.Addr().Unmap()
+			if isTrusted(addr, trustedProxies) {
+				hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+				for i := len(hops) - 1; i >= 0 && isTrusted(addr, trustedProxies); i-- {
+					hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+					if err != nil {
+						break
+					}
+					addr = hop.Unmap()
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, addr)))
+		})
+	}
+}
+
+// IsTrustedProxy reports whether the direct peer of a request is one of trustedProxies.
+func IsTrustedProxy(remoteAddr string, trustedProxies []netip.Prefix) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	return isTrusted(addrPort.Addr().Unmap(), trustedProxies)
+}
+
+func isTrusted(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func ClientIPFromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(clientIPKey{}).(netip.Addr)
+	return addr, ok
+}
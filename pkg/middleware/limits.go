@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+)
+
+// MaxBodySize limits request bodies to limit bytes. Reading past the limit fails
+// with *http.MaxBytesError, which handlers report as 413. A non-positive limit disables the check.
+func MaxBodySize(limit int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				problem.Error(w, r, http.StatusRequestEntityTooLarge, problem.CodeRequestTooLarge, "request body is too large")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Timeout bounds the time a handler may take. The request context is cancelled at the deadline
+// and the client gets a 503 problem response if the handler has not responded by then.
+func Timeout(timeout time.Duration) Middleware {
+	body, _ := json.Marshal(problem.New(http.StatusServiceUnavailable, problem.CodeRequestTimeout, "request timed out"))
+
+	return func(next http.Handler) http.Handler {
+		timeoutHandler := http.TimeoutHandler(next, timeout, string(body))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeoutHandler.ServeHTTP(timeoutResponseWriter{w}, r)
+		})
+	}
+}
+
+// timeoutResponseWriter marks the body written by http.TimeoutHandler on timeout as a problem document.
+type timeoutResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w timeoutResponseWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", problem.ContentType)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w timeoutResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/logging"
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+	"github.com/google/uuid"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps handler with middlewares. The first middleware is the outermost one,
+// so it sees the request first and the response last.
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+type requestIDKey struct{}
+
+// RequestID propagates the request ID of the caller or generates a new one.
+// The ID is echoed in the response, stored in the request context and attached to context-aware log records.
+func RequestID() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !isValidRequestID(id) {
+				id = uuid.New().String()
+			}
+
+			w.Header().Set(RequestIDHeader, id)
+			ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+			ctx = logging.WithAttrs(ctx, slog.String("request_id", id))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// isValidRequestID accepts caller-provided IDs of reasonable length made of printable ASCII,
+// so that they cannot be used to inject content into logs and headers.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessLog logs every completed request with its status, size and latency.
+func AccessLog() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := NewStatusRecorder(w)
+
+			next.ServeHTTP(recorder, r)
+
+			slog.InfoContext(r.Context(), "Request completed",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", recorder.Status()),
+				slog.Int64("bytes", recorder.Bytes()),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("user_agent", r.UserAgent()),
+			)
+		})
+	}
+}
+
+// Recover turns panics in handlers into 500 responses instead of dropped connections.
+func Recover() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := NewStatusRecorder(w)
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				slog.ErrorContext(r.Context(), "Recovered from panic in handler",
+					slog.Any("panic", err),
+					slog.String("path", r.URL.Path),
+					slog.String("stack", string(debug.Stack())),
+				)
+				if !recorder.WroteHeader() {
+					problem.Error(recorder, r, http.StatusInternalServerError, problem.CodeInternalError, "internal server error")
+				}
+			}()
+
+			next.ServeHTTP(recorder, r)
+		})
+	}
+}
+
+// StatusRecorder captures the status code and size of a response.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	if recorder, ok := w.(*StatusRecorder); ok {
+		return recorder
+	}
+	return &StatusRecorder{ResponseWriter: w}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *StatusRecorder) WroteHeader() bool {
+	return r.status != 0
+}
+
+func (r *StatusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *StatusRecorder) Bytes() int64 {
+	return r.bytes
+}
@@ -0,0 +1,155 @@
+package middleware_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) middleware.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	handler := middleware.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mark("first"), mark("second"))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, []string{"first", "second", "handler"}, order)
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := middleware.RequestID()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = middleware.RequestIDFromContext(r.Context())
+	}))
+
+	// Generated when missing
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NotEmpty(t, seen)
+	assert.Equal(t, seen, w.Header().Get(middleware.RequestIDHeader))
+
+	// Propagated when provided
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(middleware.RequestIDHeader, "upstream-id-1")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "upstream-id-1", seen)
+	assert.Equal(t, "upstream-id-1", w.Header().Get(middleware.RequestIDHeader))
+
+	// Replaced when unsafe
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(middleware.RequestIDHeader, "bad id\twith spaces")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.NotEqual(t, "bad id\twith spaces", seen)
+}
+
+func TestRecover(t *testing.T) {
+	handler := middleware.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), middleware.AccessLog(), middleware.Recover())
+
+	w := httptest.NewRecorder()
+	assert.NotPanics(t, func() {
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+}
+
+func TestMaxBodySize(t *testing.T) {
+	var readErr error
+	handler := middleware.MaxBodySize(8)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("small")))
+	assert.NoError(t, readErr)
+
+	// Declared length over the limit is rejected upfront
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("definitely too large")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// Streamed bodies fail while reading
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(bytes.NewBufferString("definitely too large")))
+	req.ContentLength = -1
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	var maxBytesErr *http.MaxBytesError
+	assert.ErrorAs(t, readErr, &maxBytesErr)
+}
+
+func TestTimeout(t *testing.T) {
+	handler := middleware.Timeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+
+	var body map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "request_timeout", body["code"])
+
+	// Fast handlers are not affected
+	handler = middleware.Timeout(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Type"))
+}
+
+func TestClientIP(t *testing.T) {
+	handler := middleware.ClientIP([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	ip := func(remoteAddr string, forwardedFor ...string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for _, value := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		var addr netip.Addr
+		handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, _ = middleware.ClientIPFromContext(r.Context())
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		return addr.String()
+	}
+
+	assert.Equal(t, "192.0.2.1", ip("192.0.2.1:1234"))
+	// Clients connecting directly cannot choose their address
+	assert.Equal(t, "192.0.2.1", ip("192.0.2.1:1234", "198.51.100.7"))
+	// Trusted proxies are skipped, spoofed hops in front of the client are ignored
+	assert.Equal(t, "198.51.100.7", ip("10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "10.0.0.2"))
+	// Without a forwarded address the proxy itself is the client
+	assert.Equal(t, "10.0.0.1", ip("10.0.0.1:1234"))
+	assert.Equal(t, "2001:db8::1", ip("[::ffff:10.0.0.1]:1234", "2001:db8::1"))
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	assert.True(t, middleware.IsTrustedProxy("10.0.0.1:1234", trusted))
+	assert.True(t, middleware.IsTrustedProxy("[::ffff:10.0.0.1]:1234", trusted))
+	assert.False(t, middleware.IsTrustedProxy("192.0.2.1:1234", trusted))
+	assert.False(t, middleware.IsTrustedProxy("pipe", trusted))
+}
@@ -0,0 +1,187 @@
+package mtls
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/logging"
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+)
+
+const CodeClientCertificateRequired = "client_certificate_required"
+
+var ErrMalformedCertificate = errors.New("malformed certificate")
+
+// Identity is the verified client certificate of a mutual TLS connection.
+type Identity struct {
+	Subject     string
+	CommonName  string
+	DNSNames    []string
+	URIs        []string
+	Thumbprint  string // base64url SHA-256 of the DER certificate, as in the x5t#S256 confirmation method of RFC 8705
+	Certificate *x509.Certificate
+	Forwarded   bool // the certificate was verified by a trusted proxy
+}
+
+func NewIdentity(cert *x509.Certificate) *Identity {
+	uris := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	return &Identity{
+		Subject:     cert.Subject.String(),
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		URIs:        uris,
+		Thumbprint:  Thumbprint(cert),
+		Certificate: cert,
+	}
+}
+
+// Thumbprint returns the base64url-encoded SHA-256 hash of the DER encoding of cert.
+func Thumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// FromRequest returns the identity of the client certificate verified during the TLS handshake.
+// Certificates that were presented but not verified against the client CA are ignored.
+func FromRequest(r *http.Request) (*Identity, bool) {
+	if r.TLS == nil {
+		return nil, false
+	}
+	return FromConnectionState(*r.TLS)
+}
+
+// FromConnectionState returns the identity of the verified client certificate of a TLS connection.
+func FromConnectionState(state tls.ConnectionState) (*Identity, bool) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return NewIdentity(state.VerifiedChains[0][0]), true
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// Identify stores the verified client identity in the request context and attaches its subject to log records.
+func Identify() middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if identity, ok := FromRequest(r); ok {
+				ctx := WithIdentity(r.Context(), identity)
+				ctx = logging.WithAttrs(ctx, slog.String("client_subject", identity.Subject))
+				r = r.WithContext(ctx)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Require rejects requests without a verified client certificate.
+func Require() middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := FromContext(r.Context()); !ok {
+				slog.DebugContext(r.Context(), "Rejected request without client certificate", slog.String("path", r.URL.Path))
+				problem.Error(w, r, http.StatusForbidden, CodeClientCertificateRequired, "a verified client certificate is required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IdentifyForwarded trusts the client certificate that a TLS-terminating proxy forwards in header,
+// such as the $ssl_client_escaped_cert variable of NGINX. The header is only honoured for requests
+// coming from trusted proxies; it replaces the identity of the proxy's own client certificate.
+func IdentifyForwarded(header string, trustedProxies []netip.Prefix) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get(header)
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !middleware.IsTrustedProxy(r.RemoteAddr, trustedProxies) {
+				slog.DebugContext(r.Context(), "Ignoring forwarded client certificate from untrusted peer", slog.String("remote_addr", r.RemoteAddr))
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cert, err := ParseForwardedCertificate(value)
+			if err != nil {
+				slog.WarnContext(r.Context(), "Ignoring malformed forwarded client certificate", slog.Any("error", err))
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity := NewIdentity(cert)
+			identity.Forwarded = true
+			ctx := WithIdentity(r.Context(), identity)
+			ctx = logging.WithAttrs(ctx, slog.String("client_subject", identity.Subject))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ParseForwardedCertificate decodes a certificate forwarded by a proxy, either as a PEM block,
+// which may be URL-encoded, or as base64-encoded DER.
+func ParseForwardedCertificate(value string) (*x509.Certificate, error) {
+	if strings.Contains(value, "%") {
+		unescaped, err := url.QueryUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		value = unescaped
+	}
+
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		return x509.ParseCertificate(block.Bytes)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, ErrMalformedCertificate
+	}
+	return x509.ParseCertificate(der)
+}
+
+// ParsePrefixes parses a list of networks in CIDR notation. Single addresses are accepted as well.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
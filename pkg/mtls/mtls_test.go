@@ -0,0 +1,138 @@
+package mtls_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/GregoryKogan/jwt-microservice/pkg/mtls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	spiffe, _ := url.Parse("spiffe://example.org/gateway")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gateway", Organization: []string{"Example"}},
+		DNSNames:     []string{"gateway.internal"},
+		URIs:         []*url.URL{spiffe},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestIdentifyAndRequire(t *testing.T) {
+	cert := newCertificate(t)
+
+	var identity *mtls.Identity
+	handler := middleware.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = mtls.FromContext(r.Context())
+	}), mtls.Identify(), mtls.Require())
+
+	// Without a verified certificate
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/authenticate", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), mtls.CodeClientCertificateRequired)
+
+	// Presented but unverified certificates are ignored
+	req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Verified certificate
+	req = httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.NotNil(t, identity)
+	assert.Equal(t, "gateway", identity.CommonName)
+	assert.Equal(t, "CN=gateway,O=Example", identity.Subject)
+	assert.Equal(t, []string{"gateway.internal"}, identity.DNSNames)
+	assert.Equal(t, []string{"spiffe://example.org/gateway"}, identity.URIs)
+	assert.Equal(t, mtls.Thumbprint(cert), identity.Thumbprint)
+	assert.Len(t, identity.Thumbprint, 43)
+}
+
+func TestIdentifyForwarded(t *testing.T) {
+	cert := newCertificate(t)
+	trusted, err := mtls.ParsePrefixes([]string{"10.0.0.0/8", "192.168.1.10"})
+	require.NoError(t, err)
+
+	var identity *mtls.Identity
+	handler := middleware.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = mtls.FromContext(r.Context())
+	}), mtls.IdentifyForwarded("X-Client-Cert", trusted))
+
+	pemCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	formats := map[string]string{
+		"escaped PEM": url.QueryEscape(pemCert),
+		"base64 DER":  base64.StdEncoding.EncodeToString(cert.Raw),
+	}
+	for name, value := range formats {
+		identity = nil
+		req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+		req.RemoteAddr = "10.1.2.3:41000"
+		req.Header.Set("X-Client-Cert", value)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		require.NotNil(t, identity, name)
+		assert.True(t, identity.Forwarded, name)
+		assert.Equal(t, mtls.Thumbprint(cert), identity.Thumbprint, name)
+	}
+
+	// Single addresses are trusted as well
+	identity = nil
+	req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.RemoteAddr = "192.168.1.10:41000"
+	req.Header.Set("X-Client-Cert", formats["base64 DER"])
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NotNil(t, identity)
+
+	// Untrusted peers cannot assert a certificate
+	identity = nil
+	req = httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.RemoteAddr = "203.0.113.7:41000"
+	req.Header.Set("X-Client-Cert", formats["base64 DER"])
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Nil(t, identity)
+
+	// Malformed values are ignored
+	req = httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.RemoteAddr = "10.1.2.3:41000"
+	req.Header.Set("X-Client-Cert", "not a certificate")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Nil(t, identity)
+}
+
+func TestParsePrefixes(t *testing.T) {
+	_, err := mtls.ParsePrefixes([]string{"not-a-network"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,65 @@
+package problem
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+const ContentType = "application/problem+json"
+
+// Codes shared by all handlers. Packages define their own domain-specific codes.
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeNotFound         = "not_found"
+	CodeRequestTooLarge  = "request_too_large"
+	CodeRequestTimeout   = "request_timeout"
+	CodeInternalError    = "internal_error"
+)
+
+// Problem is an RFC 7807 problem details object extended with a stable,
+// machine-readable error code.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+func New(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   TypeURI(code),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// TypeURI identifies the problem type of an error code.
+func TypeURI(code string) string {
+	return "urn:jwt-microservice:problem:" + code
+}
+
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	p.Instance = r.URL.Path
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		slog.Error("Failed to encode problem response", "error", err)
+	}
+}
+
+// Error writes a problem with the given status, code and detail.
+func Error(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	Write(w, r, New(status, code, detail))
+}
+
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Error(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method "+r.Method+" is not allowed")
+}
@@ -0,0 +1,31 @@
+package ratelimit
+
+import (
+	"net/http"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/GregoryKogan/jwt-microservice/pkg/mtls"
+)
+
+// ClientIP keys requests by the client address found by middleware.ClientIP. IPv6 clients are
+// keyed by their /64 network, which a single host usually controls entirely.
+func ClientIP(_ string, r *http.Request) (string, bool) {
+	addr, ok := middleware.ClientIPFromContext(r.Context())
+	if !ok {
+		return "", false
+	}
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String(), true
+	}
+	return addr.String(), true
+}
+
+// Client keys requests by the thumbprint of their verified client certificate.
+func Client(_ string, r *http.Request) (string, bool) {
+	identity, ok := mtls.FromContext(r.Context())
+	if !ok {
+		return "", false
+	}
+	return identity.Thumbprint, true
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// localLimiter applies the same algorithm as the Redis script to buckets held in memory.
+// Each instance only counts the requests it receives, so limits are multiplied by the
+// number of instances while it is in use.
+type localLimiter struct {
+	mu        sync.Mutex
+	tat       map[string]time.Time
+	lastPrune time.Time
+}
+
+func newLocalLimiter() *localLimiter {
+	return &localLimiter{tat: map[string]time.Time{}}
+}
+
+func (l *localLimiter) Allow(key string, rule Rule, now time.Time) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Buckets whose TAT has passed are full again, so they are dropped
+	if now.Sub(l.lastPrune) > time.Minute {
+		for k, tat := range l.tat {
+			if !tat.After(now) {
+				delete(l.tat, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	tat := l.tat[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	if tat.Add(rule.interval()).Sub(now) > rule.capacity() {
+		return decide(rule, false, tat.Sub(now))
+	}
+
+	tat = tat.Add(rule.interval())
+	l.tat[key] = tat
+	return decide(rule, true, tat.Sub(now))
+}
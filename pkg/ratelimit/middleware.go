@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+)
+
+const CodeRateLimited = "rate_limited"
+
+// KeyFunc returns the value that a request to route is counted under, or false when the
+// request has none, in which case the rules on the key do not apply to it.
+type KeyFunc func(route string, r *http.Request) (string, bool)
+
+// Middleware checks the requests to route against its rules, in order, and rejects the first
+// one exceeding a rule with a 429 problem carrying Retry-After. Rules after it are not counted.
+// Responses carry the RateLimit-* headers of the rule closest to being exceeded.
+func Middleware(limiter Limiter, route string, rules []Rule, keys map[string]KeyFunc) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(rules) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				closest     Decision
+				closestRule Rule
+				checked     bool
+			)
+			for i, rule := range rules {
+				key, ok := keys[rule.Key]
+				if !ok {
+					continue
+				}
+				value, ok := key(route, r)
+				if !ok {
+					continue
+				}
+
+				decision := limiter.Allow(r.Context(), fmt.Sprintf("%s:%d:%s:%s", route, i, rule.Key, value), rule)
+				if !checked || !decision.Allowed || decision.Remaining < closest.Remaining {
+					closest, closestRule, checked = decision, rule, true
+				}
+				if !decision.Allowed {
+					metrics.RateLimitDecisions.WithLabelValues(route, rule.Key, metrics.RateLimitLimited).Inc()
+					break
+				}
+				metrics.RateLimitDecisions.WithLabelValues(route, rule.Key, metrics.RateLimitAllowed).Inc()
+			}
+			if !checked {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			writeHeaders(w.Header(), closestRule, closest)
+			if !closest.Allowed {
+				slog.WarnContext(r.Context(), "Rate limit exceeded", slog.String("route", route), slog.String("key", closestRule.Key), slog.Duration("retry_after", closest.RetryAfter))
+				w.Header().Set("Retry-After", strconv.Itoa(max(seconds(closest.RetryAfter), 1)))
+				problem.Error(w, r, http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded, retry later")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeHeaders sets the RateLimit-* headers of the IETF draft on rate limit headers.
+// The policy reports the burst of the rule as an extension parameter.
+func writeHeaders(header http.Header, rule Rule, decision Decision) {
+	header.Set("RateLimit-Limit", strconv.Itoa(rule.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(seconds(decision.Reset)))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", rule.Limit, seconds(rule.Period), rule.Burst))
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
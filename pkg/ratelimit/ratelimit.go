@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+// Keys that rules count requests by.
+const (
+	KeyIP     = "ip"     // address of the client, see ClientIP
+	KeyUser   = "user"   // subject of the request
+	KeyClient = "client" // thumbprint of the verified client certificate
+)
+
+var ErrInvalidRule = errors.New("invalid rate limit rule")
+
+// Rule allows Limit requests per Period for every value of Key. Up to Burst requests,
+// Limit by default, may be made at once, after which they are spread evenly over the period.
+type Rule struct {
+	Key    string        `mapstructure:"key"`
+	Limit  int           `mapstructure:"limit"`
+	Period time.Duration `mapstructure:"period"`
+	Burst  int           `mapstructure:"burst"`
+}
+
+// interval is the time it takes to regain a single request.
+func (r Rule) interval() time.Duration {
+	return r.Period / time.Duration(r.Limit)
+}
+
+// capacity is the time it takes to regain the whole burst.
+func (r Rule) capacity() time.Duration {
+	return r.interval() * time.Duration(r.Burst)
+}
+
+// NewRules reads the rules of every route from rate_limit.routes.
+func NewRules() (map[string][]Rule, error) {
+	var routes map[string][]Rule
+	if err := viper.UnmarshalKey("rate_limit.routes", &routes); err != nil {
+		return nil, errors.Join(ErrInvalidRule, err)
+	}
+
+	for route, rules := range routes {
+		for i, rule := range rules {
+			if !slices.Contains([]string{KeyIP, KeyUser, KeyClient}, rule.Key) {
+				return nil, errors.Join(ErrInvalidRule, fmt.Errorf("route %s: unknown key %q", route, rule.Key))
+			}
+			// Buckets are kept in microseconds
+			if rule.Limit <= 0 || rule.Burst < 0 || rule.Period < time.Duration(rule.Limit)*time.Microsecond {
+				return nil, errors.Join(ErrInvalidRule, fmt.Errorf("route %s: limit, period and burst must be positive", route))
+			}
+			if rule.Burst == 0 {
+				rules[i].Burst = rule.Limit
+			}
+		}
+	}
+	return routes, nil
+}
+
+// Decision is the outcome of checking a request against a rule.
+type Decision struct {
+	Allowed    bool
+	Remaining  int           // requests that may still be made at once
+	RetryAfter time.Duration // until the request would be allowed, zero when it was
+	Reset      time.Duration // until the whole burst is available again
+}
+
+// decide derives the decision from the time the bucket of rule is occupied for,
+// counting the request when it was allowed.
+func decide(rule Rule, allowed bool, occupied time.Duration) Decision {
+	decision := Decision{Allowed: allowed, Reset: occupied}
+	if allowed {
+		decision.Remaining = int((rule.capacity() - occupied) / rule.interval())
+	} else {
+		decision.RetryAfter = occupied + rule.interval() - rule.capacity()
+	}
+	return decision
+}
+
+type Limiter interface {
+	// Allow counts a request against the bucket of key under rule.
+	Allow(ctx context.Context, key string, rule Rule) Decision
+}
+
+// LimiterImpl implements the generic cell rate algorithm (GCRA) in Redis, so that limits are
+// shared by every instance as long as their clocks agree. While Redis is unavailable, each
+// instance falls back to enforcing the limits on its own.
+type LimiterImpl struct {
+	cache   *redis.Client
+	timeout time.Duration
+	local   *localLimiter
+}
+
+func NewLimiter(cache *redis.Client) Limiter {
+	timeout := viper.GetDuration("rate_limit.timeout")
+	if timeout <= 0 {
+		timeout = 100 * time.Millisecond
+	}
+	return &LimiterImpl{
+		cache:   cache,
+		timeout: timeout,
+		local:   newLocalLimiter(),
+	}
+}
+
+// gcra stores the theoretical arrival time (TAT) of the next request in microseconds. A request
+// is allowed when, counting it, the TAT lies no further ahead than the capacity of the rule.
+// The script returns whether the request was allowed and how far ahead the TAT lies.
+var gcra = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+
+local tat = math.max(tonumber(redis.call("GET", KEYS[1]) or now), now)
+if tat + interval - now > capacity then
+	return {0, tat - now}
+end
+
+tat = tat + interval
+redis.call("SET", KEYS[1], string.format("%.0f", tat), "PX", math.ceil((tat - now) / 1000))
+return {1, tat - now}
+`)
+
+func (l *LimiterImpl) Allow(ctx context.Context, key string, rule Rule) Decision {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	now := time.Now()
+	result, err := gcra.Run(ctx, l.cache, []string{"ratelimit:" + key},
+		now.UnixMicro(), rule.interval().Microseconds(), rule.capacity().Microseconds(),
+	).Int64Slice()
+	if err != nil || len(result) != 2 {
+		slog.DebugContext(ctx, "Failed to check rate limit in Redis, deciding locally", slog.Any("error", err))
+		metrics.RateLimitFallbacks.Inc()
+		return l.local.Allow(key, rule, now)
+	}
+	return decide(rule, result[0] == 1, time.Duration(result[1])*time.Microsecond)
+}
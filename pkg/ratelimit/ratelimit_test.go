@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/metrics"
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/GregoryKogan/jwt-microservice/pkg/problem"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRules(t *testing.T) {
+	viper.Set("rate_limit.routes", map[string]any{
+		"login": []map[string]any{
+			{"key": "ip", "limit": 10, "period": "1m"},
+			{"key": "user", "limit": 5, "period": "1h", "burst": 2},
+		},
+	})
+	defer viper.Set("rate_limit.routes", nil)
+
+	rules, err := NewRules()
+	require.NoError(t, err)
+	assert.Equal(t, []Rule{
+		{Key: KeyIP, Limit: 10, Period: time.Minute, Burst: 10},
+		{Key: KeyUser, Limit: 5, Period: time.Hour, Burst: 2},
+	}, rules["login"])
+
+	viper.Set("rate_limit.routes", map[string]any{"login": []map[string]any{{"key": "tenant", "limit": 1, "period": "1s"}}})
+	_, err = NewRules()
+	assert.ErrorIs(t, err, ErrInvalidRule)
+
+	viper.Set("rate_limit.routes", map[string]any{"login": []map[string]any{{"key": "ip", "limit": 0, "period": "1s"}}})
+	_, err = NewRules()
+	assert.ErrorIs(t, err, ErrInvalidRule)
+}
+
+func TestLocalLimiter(t *testing.T) {
+	limiter := newLocalLimiter()
+	rule := Rule{Key: KeyIP, Limit: 2, Period: time.Second, Burst: 2}
+	now := time.Now()
+
+	decision := limiter.Allow("key", rule, now)
+	assert.Equal(t, Decision{Allowed: true, Remaining: 1, Reset: 500 * time.Millisecond}, decision)
+	decision = limiter.Allow("key", rule, now)
+	assert.Equal(t, Decision{Allowed: true, Remaining: 0, Reset: time.Second}, decision)
+
+	// The burst is spent, a request is regained every 500ms
+	decision = limiter.Allow("key", rule, now.Add(100*time.Millisecond))
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 400*time.Millisecond, decision.RetryAfter)
+	assert.True(t, limiter.Allow("key", rule, now.Add(500*time.Millisecond)).Allowed)
+
+	// Buckets are independent
+	assert.True(t, limiter.Allow("other", rule, now).Allowed)
+}
+
+func newDeadLimiter() Limiter {
+	// Nothing listens on port 1
+	return NewLimiter(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1}))
+}
+
+func TestLimiterFallsBackLocally(t *testing.T) {
+	limiter := newDeadLimiter()
+	rule := Rule{Key: KeyIP, Limit: 1, Period: time.Hour, Burst: 1}
+
+	fallbacks := testutil.ToFloat64(metrics.RateLimitFallbacks)
+	assert.True(t, limiter.Allow(context.Background(), "fallback", rule).Allowed)
+	assert.False(t, limiter.Allow(context.Background(), "fallback", rule).Allowed)
+	assert.Equal(t, fallbacks+2, testutil.ToFloat64(metrics.RateLimitFallbacks))
+}
+
+func TestMiddleware(t *testing.T) {
+	rules := []Rule{
+		{Key: KeyClient, Limit: 100, Period: time.Minute, Burst: 100},
+		{Key: KeyIP, Limit: 3, Period: time.Minute, Burst: 3},
+		{Key: KeyUser, Limit: 1, Period: time.Minute, Burst: 1},
+	}
+	users := 0
+	keys := map[string]KeyFunc{
+		KeyIP:     ClientIP,
+		KeyClient: Client,
+		KeyUser: func(route string, r *http.Request) (string, bool) {
+			users++
+			return r.Header.Get("X-User"), r.Header.Get("X-User") != ""
+		},
+	}
+	handler := middleware.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), middleware.ClientIP(nil), Middleware(newDeadLimiter(), "login", rules, keys))
+
+	request := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Requests without a client certificate are not counted by the client rule
+	w := request("")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "3", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "3;w=60;burst=3", w.Header().Get("RateLimit-Policy"))
+
+	// The user rule is closest to being exceeded
+	w = request("alice")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+
+	// Other users have buckets of their own
+	assert.Equal(t, http.StatusNoContent, request("bob").Code)
+
+	// The IP rule rejects the request before the user rule is counted
+	users = 0
+	w = request("carol")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, 0, users)
+	assert.Equal(t, "20", w.Header().Get("Retry-After"))
+	assert.Equal(t, "3", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	var p problem.Problem
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.Equal(t, CodeRateLimited, p.Code)
+	assert.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+}
+
+func TestClientIP(t *testing.T) {
+	ip := func(remoteAddr string) (string, bool) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		var key string
+		var ok bool
+		middleware.ClientIP(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok = ClientIP("login", r)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		return key, ok
+	}
+
+	key, ok := ip("192.0.2.1:1234")
+	assert.True(t, ok)
+	assert.Equal(t, "192.0.2.1", key)
+	key, _ = ip("[2001:db8:1:2:3:4:5:6]:1234")
+	assert.Equal(t, "2001:db8:1:2::/64", key)
+	_, ok = ip("unknown")
+	assert.False(t, ok)
+}
@@ -3,12 +3,21 @@ package secrets
 import (
 	"log/slog"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/viper"
 )
 
+// Dir is where secrets are mounted, as done by Docker and Kubernetes.
+const Dir = "/run/secrets"
+
+// Path returns the file path of the named secret.
+func Path(name string) string {
+	return filepath.Join(Dir, name)
+}
+
 func LoadSecretsIntoViper() error {
-	files, err := os.ReadDir("/run/secrets")
+	files, err := os.ReadDir(Dir)
 	if err != nil {
 		slog.Error("Failed to read secrets directory", slog.Any("error", err))
 		return err
@@ -33,7 +42,7 @@ func LoadSecretsIntoViper() error {
 }
 
 func readSecret(secret string) (string, error) {
-	buffer, err := os.ReadFile("/run/secrets/" + secret)
+	buffer, err := os.ReadFile(Path(secret))
 	if err != nil {
 		slog.Error("failed to read secret", slog.Any("secret", secret), slog.Any("error", err))
 		return "", err
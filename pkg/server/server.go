@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/mtls"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 10 * time.Second
+	defaultWriteTimeout      = 15 * time.Second
+	defaultIdleTimeout       = 60 * time.Second
+	defaultShutdownTimeout   = 15 * time.Second
+)
+
+// NewHTTPServer builds an HTTP server with every timeout set from the server.* config.
+// Unset timeouts fall back to conservative defaults so that slow clients cannot hold connections forever.
+func NewHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + viper.GetString("server.port"),
+		Handler:           handler,
+		ReadHeaderTimeout: config.DurationOrDefault("server.read_header_timeout", defaultReadHeaderTimeout),
+		ReadTimeout:       config.DurationOrDefault("server.read_timeout", defaultReadTimeout),
+		WriteTimeout:      config.DurationOrDefault("server.write_timeout", defaultWriteTimeout),
+		IdleTimeout:       config.DurationOrDefault("server.idle_timeout", defaultIdleTimeout),
+		MaxHeaderBytes:    int(viper.GetSizeInBytes("server.max_header_size")),
+	}
+}
+
+// ShutdownTimeout is how long in-flight requests may take to drain after a termination signal.
+func ShutdownTimeout() time.Duration {
+	return config.DurationOrDefault("server.shutdown_timeout", defaultShutdownTimeout)
+}
+
+// TrustedProxies returns the networks of server.trusted_proxies, the proxies whose forwarding
+// headers describe the original request.
+func TrustedProxies() ([]netip.Prefix, error) {
+	return mtls.ParsePrefixes(viper.GetStringSlice("server.trusted_proxies"))
+}
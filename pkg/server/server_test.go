@@ -0,0 +1,44 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/server"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHTTPServerDefaults(t *testing.T) {
+	viper.Reset()
+	viper.Set("server.port", "8080")
+
+	srv := server.NewHTTPServer(http.NotFoundHandler())
+	assert.Equal(t, ":8080", srv.Addr)
+	assert.Equal(t, 5*time.Second, srv.ReadHeaderTimeout)
+	assert.Equal(t, 10*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 15*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 60*time.Second, srv.IdleTimeout)
+	assert.Equal(t, 15*time.Second, server.ShutdownTimeout())
+}
+
+func TestNewHTTPServerConfig(t *testing.T) {
+	viper.Reset()
+	viper.Set("server.port", "9000")
+	viper.Set("server.read_header_timeout", "1s")
+	viper.Set("server.read_timeout", "2s")
+	viper.Set("server.write_timeout", "3s")
+	viper.Set("server.idle_timeout", "4s")
+	viper.Set("server.shutdown_timeout", "5s")
+	viper.Set("server.max_header_size", "16kb")
+
+	srv := server.NewHTTPServer(http.NotFoundHandler())
+	assert.Equal(t, ":9000", srv.Addr)
+	assert.Equal(t, time.Second, srv.ReadHeaderTimeout)
+	assert.Equal(t, 2*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 3*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 4*time.Second, srv.IdleTimeout)
+	assert.Equal(t, 16*1024, srv.MaxHeaderBytes)
+	assert.Equal(t, 5*time.Second, server.ShutdownTimeout())
+}
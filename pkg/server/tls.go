@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/secrets"
+	"github.com/spf13/viper"
+)
+
+const defaultTLSReloadInterval = 30 * time.Second
+
+var (
+	ErrInvalidClientAuth = errors.New("invalid client auth mode")
+	ErrMissingClientCA   = errors.New("client certificate verification requires a client CA")
+)
+
+// NewTLSConfig builds the TLS configuration of the HTTP and gRPC servers from the server.tls.* config.
+// It returns nil when TLS is disabled. The certificate, key and client CA bundle are read from the
+// secrets directory and reloaded when their files change, so that certificates and trust anchors
+// can be rotated without a restart.
+func NewTLSConfig() (*tls.Config, error) {
+	if !viper.GetBool("server.tls.enabled") {
+		return nil, nil
+	}
+
+	clientAuth, err := parseClientAuth(viper.GetString("server.tls.client_auth"))
+	if err != nil {
+		return nil, err
+	}
+
+	caPath := ""
+	if clientAuth != tls.NoClientCert {
+		caSecret := viper.GetString("server.tls.client_ca_secret")
+		if caSecret == "" {
+			return nil, ErrMissingClientCA
+		}
+		caPath = secrets.Path(caSecret)
+	}
+
+	reloader, err := newCertReloader(
+		secrets.Path(config.StringOrDefault("server.tls.cert_secret", "tls_cert")),
+		secrets.Path(config.StringOrDefault("server.tls.key_secret", "tls_key")),
+		caPath,
+		config.DurationOrDefault("server.tls.reload_interval", defaultTLSReloadInterval),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		ClientAuth:     clientAuth,
+		GetCertificate: reloader.GetCertificate,
+		// Set here because the configuration returned for each client replaces the one the
+		// HTTP and gRPC servers would otherwise extend with their protocols
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if viper.GetString("server.tls.min_version") == "1.3" {
+		tlsConfig.MinVersion = tls.VersionTLS13
+	}
+	if caPath != "" {
+		tlsConfig.GetConfigForClient = reloader.configForClient(tlsConfig.Clone())
+	}
+
+	return tlsConfig, nil
+}
+
+// parseClientAuth maps the client_auth setting to a TLS policy. With "optional", certificates are
+// verified when presented and individual routes decide whether they are required.
+func parseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("%w: %q", ErrInvalidClientAuth, mode)
+	}
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certReloader serves a certificate key pair, and optionally a pool of client CAs, and reloads them
+// once the files have changed. Files are checked at most once per interval, and files that fail to
+// load keep the previous ones in use.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	caPath   string // empty without client certificate verification
+	interval time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certPath, keyPath, caPath string, interval time.Duration) (*certReloader, error) {
+	reloader := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		caPath:   caPath,
+		interval: interval,
+	}
+
+	modTime, err := reloader.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := reloader.load(modTime); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := c.current()
+	return cert, nil
+}
+
+// configForClient returns a GetConfigForClient callback that serves base with the current client CAs.
+func (c *certReloader) configForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		_, clientCAs := c.current()
+		tlsConfig := base.Clone()
+		tlsConfig.ClientCAs = clientCAs
+		return tlsConfig, nil
+	}
+}
+
+func (c *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checkedAt) >= c.interval {
+		c.checkedAt = time.Now()
+		if modTime, err := c.latestModTime(); err != nil {
+			slog.Warn("Failed to check TLS certificate files", slog.Any("error", err))
+		} else if !modTime.Equal(c.modTime) {
+			if err := c.load(modTime); err != nil {
+				slog.Error("Failed to reload TLS certificates, keeping the previous ones", slog.Any("error", err))
+			} else {
+				slog.Info("Reloaded TLS certificates", slog.String("cert", c.certPath), slog.String("client_ca", c.caPath))
+			}
+		}
+	}
+	return c.cert, c.clientCAs
+}
+
+func (c *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if c.caPath != "" {
+		if clientCAs, err = loadCertPool(c.caPath); err != nil {
+			return err
+		}
+	}
+
+	c.cert, c.clientCAs = &cert, clientCAs
+	c.modTime = modTime
+	c.checkedAt = time.Now()
+	return nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certPath, c.keyPath, c.caPath} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyPair(t *testing.T, certPath, keyPath, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "tls_cert"), filepath.Join(dir, "tls_key")
+	writeKeyPair(t, certPath, keyPath, "first", time.Now().Add(-time.Hour))
+
+	reloader, err := newCertReloader(certPath, keyPath, "", 0)
+	require.NoError(t, err)
+
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, cert))
+
+	// Rotated files are picked up
+	writeKeyPair(t, certPath, keyPath, "second", time.Now())
+	cert, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", commonName(t, cert))
+
+	// A broken rotation keeps serving the previous certificate
+	require.NoError(t, os.WriteFile(keyPath, []byte("garbage"), 0o600))
+	cert, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", commonName(t, cert))
+}
+
+func TestClientCAReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, caPath := filepath.Join(dir, "tls_cert"), filepath.Join(dir, "tls_key"), filepath.Join(dir, "tls_client_ca")
+	writeKeyPair(t, certPath, keyPath, "server", time.Now().Add(-time.Hour))
+	firstCA, secondCA := filepath.Join(dir, "first_ca"), filepath.Join(dir, "second_ca")
+	writeKeyPair(t, firstCA, filepath.Join(dir, "first_ca_key"), "first-ca", time.Now())
+	writeKeyPair(t, secondCA, filepath.Join(dir, "second_ca_key"), "second-ca", time.Now())
+
+	install := func(source string, modTime time.Time) {
+		data, err := os.ReadFile(source)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(caPath, data, 0o600))
+		require.NoError(t, os.Chtimes(caPath, modTime, modTime))
+	}
+	trusts := func(config *tls.Config, ca string) bool {
+		data, err := os.ReadFile(ca)
+		require.NoError(t, err)
+		block, _ := pem.Decode(data)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		_, err = cert.Verify(x509.VerifyOptions{Roots: config.ClientCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+		return err == nil
+	}
+
+	install(firstCA, time.Now().Add(-time.Hour))
+	reloader, err := newCertReloader(certPath, keyPath, caPath, 0)
+	require.NoError(t, err)
+	getConfig := reloader.configForClient(&tls.Config{NextProtos: []string{"h2"}})
+
+	config, err := getConfig(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h2"}, config.NextProtos)
+	assert.True(t, trusts(config, firstCA))
+	assert.False(t, trusts(config, secondCA))
+
+	// A rotated trust anchor is used for the next handshakes
+	install(secondCA, time.Now())
+	config, err = getConfig(nil)
+	require.NoError(t, err)
+	assert.False(t, trusts(config, firstCA))
+	assert.True(t, trusts(config, secondCA))
+
+	// A broken bundle keeps the previous one in use
+	require.NoError(t, os.WriteFile(caPath, []byte("garbage"), 0o600))
+	config, err = getConfig(nil)
+	require.NoError(t, err)
+	assert.True(t, trusts(config, secondCA))
+}
+
+func TestCertReloaderMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, err := newCertReloader(filepath.Join(dir, "tls_cert"), filepath.Join(dir, "tls_key"), "", time.Minute)
+	assert.Error(t, err)
+}
+
+func TestParseClientAuth(t *testing.T) {
+	for mode, expected := range map[string]tls.ClientAuthType{
+		"":         tls.NoClientCert,
+		"none":     tls.NoClientCert,
+		"optional": tls.VerifyClientCertIfGiven,
+		"require":  tls.RequireAndVerifyClientCert,
+	} {
+		clientAuth, err := parseClientAuth(mode)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, clientAuth)
+	}
+
+	_, err := parseClientAuth("always")
+	assert.ErrorIs(t, err, ErrInvalidClientAuth)
+}
@@ -0,0 +1,226 @@
+package tenant
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/spf13/viper"
+)
+
+const DefaultID = "default"
+
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+type Tenant struct {
+	ID              string
+	Issuer          string
+	AccessLifetime  time.Duration
+	RefreshLifetime time.Duration
+	AutoLogout      time.Duration
+	Key             []byte
+
+	// LegacyUserIDClaim keeps numeric subjects in the user_id claim for consumers
+	// that have not migrated to sub yet.
+	LegacyUserIDClaim bool
+}
+
+// CacheKey namespaces a cache key so that sessions of different tenants never collide.
+// The default tenant keeps unprefixed keys for compatibility with existing sessions.
+func (t *Tenant) CacheKey(key string) string {
+	if t.ID == DefaultID {
+		return key
+	}
+	return fmt.Sprintf("tenant:%s:%s", t.ID, key)
+}
+
+type Registry interface {
+	Resolve(r *http.Request) (*Tenant, error)
+	ResolveHeaders(host string, header http.Header) (*Tenant, error)
+	Get(id string) (*Tenant, error)
+	Default() *Tenant
+	All() []*Tenant
+	PathPrefix() string
+}
+
+type RegistryImpl struct {
+	resolver   string
+	header     string
+	pathPrefix string
+	tenants    map[string]*Tenant
+	hosts      map[string]*Tenant
+
+	// defaultFallback serves requests that identify no tenant, or an unknown host, with the
+	// default tenant instead of rejecting them.
+	defaultFallback bool
+}
+
+func NewRegistry() (Registry, error) {
+	r := &RegistryImpl{
+		resolver:   viper.GetString("tenancy.resolver"),
+		header:     viper.GetString("tenancy.header"),
+		pathPrefix: strings.TrimSuffix(viper.GetString("tenancy.path_prefix"), "/"),
+		tenants:    make(map[string]*Tenant),
+		hosts:      make(map[string]*Tenant),
+
+		defaultFallback: viper.GetBool("tenancy.default_fallback"),
+	}
+	if r.header == "" {
+		r.header = "X-Tenant-ID"
+	}
+	if r.pathPrefix == "" {
+		r.pathPrefix = "/t"
+	}
+
+	switch r.resolver {
+	case "", "none", "host", "header", "path":
+	default:
+		return nil, fmt.Errorf("unsupported tenant resolver: %s", r.resolver)
+	}
+
+	r.tenants[DefaultID] = &Tenant{
+		ID:                DefaultID,
+		Issuer:            viper.GetString("auth.issuer"),
+		AccessLifetime:    viper.GetDuration("auth.access_lifetime"),
+		RefreshLifetime:   viper.GetDuration("auth.refresh_lifetime"),
+		AutoLogout:        viper.GetDuration("auth.auto_logout"),
+		Key:               []byte(viper.GetString("secrets.jwt_key")),
+		LegacyUserIDClaim: viper.GetBool("auth.legacy_user_id_claim"),
+	}
+
+	for id := range viper.GetStringMap("tenancy.tenants") {
+		t, err := loadTenant(id)
+		if err != nil {
+			return nil, err
+		}
+		r.tenants[id] = t
+
+		for _, host := range viper.GetStringSlice("tenancy.tenants." + id + ".hosts") {
+			r.hosts[strings.ToLower(host)] = t
+		}
+		slog.Debug("Loaded tenant", slog.String("tenant", id), slog.String("issuer", t.Issuer))
+	}
+
+	return r, nil
+}
+
+func loadTenant(id string) (*Tenant, error) {
+	if id == DefaultID {
+		return nil, fmt.Errorf("tenant id %q is reserved", DefaultID)
+	}
+
+	prefix := "tenancy.tenants." + id + "."
+	keySecret := viper.GetString(prefix + "key_secret")
+	if keySecret == "" {
+		keySecret = "jwt_key_" + id
+	}
+
+	key := viper.GetString("secrets." + keySecret)
+	if key == "" {
+		return nil, fmt.Errorf("missing signing key %q for tenant %q", keySecret, id)
+	}
+
+	issuer := viper.GetString(prefix + "issuer")
+	if issuer == "" {
+		issuer = viper.GetString("auth.issuer") + "/" + id
+	}
+
+	return &Tenant{
+		ID:                id,
+		Issuer:            issuer,
+		AccessLifetime:    config.DurationOrDefault(prefix+"access_lifetime", viper.GetDuration("auth.access_lifetime")),
+		RefreshLifetime:   config.DurationOrDefault(prefix+"refresh_lifetime", viper.GetDuration("auth.refresh_lifetime")),
+		AutoLogout:        config.DurationOrDefault(prefix+"auto_logout", viper.GetDuration("auth.auto_logout")),
+		Key:               []byte(key),
+		LegacyUserIDClaim: boolOrDefault(prefix+"legacy_user_id_claim", "auth.legacy_user_id_claim"),
+	}, nil
+}
+
+func boolOrDefault(key, fallback string) bool {
+	if viper.IsSet(key) {
+		return viper.GetBool(key)
+	}
+	return viper.GetBool(fallback)
+}
+
+// Resolve picks the tenant of a request using the configured resolver. Requests that carry
+// no tenant identifier, or come for an unknown host, are rejected with ErrUnknownTenant
+// unless tenancy.default_fallback is set.
+func (r *RegistryImpl) Resolve(req *http.Request) (*Tenant, error) {
+	if r.resolver == "path" {
+		return r.resolveID(req.PathValue("tenant"))
+	}
+	return r.ResolveHeaders(req.Host, req.Header)
+}
+
+// ResolveHeaders picks the tenant from the host and headers of a request.
+// It serves transports without URL paths, such as gRPC, where the path resolver
+// falls back to the tenant header.
+func (r *RegistryImpl) ResolveHeaders(host string, header http.Header) (*Tenant, error) {
+	switch r.resolver {
+	case "host":
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if t, ok := r.hosts[strings.ToLower(host)]; ok {
+			return t, nil
+		}
+		if r.defaultFallback {
+			return r.Default(), nil
+		}
+		return nil, fmt.Errorf("%w: host %s", ErrUnknownTenant, host)
+	case "header", "path":
+		return r.resolveID(header.Get(r.header))
+	default:
+		return r.Default(), nil
+	}
+}
+
+func (r *RegistryImpl) resolveID(id string) (*Tenant, error) {
+	if id == "" {
+		if r.defaultFallback {
+			return r.Default(), nil
+		}
+		return nil, fmt.Errorf("%w: no tenant identifier", ErrUnknownTenant)
+	}
+	return r.Get(id)
+}
+
+func (r *RegistryImpl) Get(id string) (*Tenant, error) {
+	t, ok := r.tenants[strings.ToLower(id)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTenant, id)
+	}
+	return t, nil
+}
+
+func (r *RegistryImpl) Default() *Tenant {
+	return r.tenants[DefaultID]
+}
+
+// All returns every configured tenant, including the default one, ordered by ID.
+func (r *RegistryImpl) All() []*Tenant {
+	tenants := make([]*Tenant, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		tenants = append(tenants, t)
+	}
+	slices.SortFunc(tenants, func(a, b *Tenant) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return tenants
+}
+
+// PathPrefix returns the route prefix for path-based resolution, or an empty string
+// when tenants are not resolved from the path.
+func (r *RegistryImpl) PathPrefix() string {
+	if r.resolver != "path" {
+		return ""
+	}
+	return r.pathPrefix + "/{tenant}"
+}
@@ -0,0 +1,118 @@
+package tenant_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/tenant"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupViper(resolver string) {
+	viper.Reset()
+	viper.Set("secrets.jwt_key", "default_secret_key")
+	viper.Set("secrets.jwt_key_acme", "acme_secret_key")
+	viper.Set("auth.issuer", "test-jwt-microservice")
+	viper.Set("auth.access_lifetime", 15*time.Minute)
+	viper.Set("auth.refresh_lifetime", 720*time.Hour)
+	viper.Set("auth.auto_logout", 24*time.Hour)
+	viper.Set("tenancy.resolver", resolver)
+	viper.Set("tenancy.tenants.acme.hosts", []string{"auth.acme.example"})
+	viper.Set("tenancy.tenants.acme.access_lifetime", 5*time.Minute)
+}
+
+func TestTenantConfiguration(t *testing.T) {
+	setupViper("none")
+
+	registry, err := tenant.NewRegistry()
+	require.NoError(t, err)
+
+	acme, err := registry.Get("acme")
+	require.NoError(t, err)
+	assert.Equal(t, "test-jwt-microservice/acme", acme.Issuer)
+	assert.Equal(t, 5*time.Minute, acme.AccessLifetime)
+	assert.Equal(t, 720*time.Hour, acme.RefreshLifetime)
+	assert.Equal(t, []byte("acme_secret_key"), acme.Key)
+	assert.Equal(t, "tenant:acme:token-1", acme.CacheKey("token-1"))
+
+	def := registry.Default()
+	assert.Equal(t, "test-jwt-microservice", def.Issuer)
+	assert.Equal(t, "token-1", def.CacheKey("token-1"))
+}
+
+func TestMissingTenantKey(t *testing.T) {
+	setupViper("none")
+	viper.Set("tenancy.tenants.globex.issuer", "globex-auth")
+
+	_, err := tenant.NewRegistry()
+	assert.Error(t, err)
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver string
+		fallback bool
+		request  func() *http.Request
+		wantID   string
+		wantErr  bool
+	}{
+		{"No resolver", "none", false, func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/login", nil)
+		}, tenant.DefaultID, false},
+		{"Known host", "host", false, func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "http://auth.acme.example:8080/login", nil)
+		}, "acme", false},
+		{"Unknown host", "host", false, func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "http://other.example/login", nil)
+		}, "", true},
+		{"Unknown host with fallback", "host", true, func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "http://other.example/login", nil)
+		}, tenant.DefaultID, false},
+		{"Header", "header", false, func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/login", nil)
+			r.Header.Set("X-Tenant-ID", "ACME")
+			return r
+		}, "acme", false},
+		{"Unknown header", "header", false, func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/login", nil)
+			r.Header.Set("X-Tenant-ID", "globex")
+			return r
+		}, "", true},
+		{"Missing header", "header", false, func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/login", nil)
+		}, "", true},
+		{"Missing header with fallback", "header", true, func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/login", nil)
+		}, tenant.DefaultID, false},
+		{"Path", "path", false, func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/t/acme/login", nil)
+			r.SetPathValue("tenant", "acme")
+			return r
+		}, "acme", false},
+		{"Missing path", "path", false, func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/login", nil)
+		}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupViper(tt.resolver)
+			viper.Set("tenancy.default_fallback", tt.fallback)
+			registry, err := tenant.NewRegistry()
+			require.NoError(t, err)
+
+			resolved, err := registry.Resolve(tt.request())
+			if tt.wantErr {
+				assert.ErrorIs(t, err, tenant.ErrUnknownTenant)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantID, resolved.ID)
+		})
+	}
+}
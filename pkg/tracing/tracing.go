@@ -0,0 +1,135 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/GregoryKogan/jwt-microservice/pkg/config"
+	"github.com/GregoryKogan/jwt-microservice/pkg/logging"
+	"github.com/GregoryKogan/jwt-microservice/pkg/middleware"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrUnsupportedExporter = errors.New("unsupported trace exporter")
+
+// Init installs the global tracer provider and the W3C trace context propagator.
+// The returned function flushes pending spans and must be called before exiting.
+// With tracing disabled spans are not recorded, but incoming trace context is still propagated.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !viper.GetBool("tracing.enabled") {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newExporter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(config.StringOrDefault("tracing.service_name", "jwt-microservice")),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	ratio := 1.0
+	if viper.IsSet("tracing.sample_ratio") {
+		ratio = viper.GetFloat64("tracing.sample_ratio")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// Follow the sampling decision of the caller so that traces are not cut in half
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("OpenTelemetry error", slog.Any("error", err))
+	}))
+
+	slog.Info("Tracing enabled", slog.String("exporter", viper.GetString("tracing.exporter")), slog.Float64("sample_ratio", ratio))
+	return provider.Shutdown, nil
+}
+
+func newExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	switch exporter := config.StringOrDefault("tracing.exporter", "otlp"); exporter {
+	case "otlp":
+		return newOTLPExporter(ctx)
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedExporter, exporter)
+	}
+}
+
+// newOTLPExporter exports over gRPC or HTTP. Unset options fall back to the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+func newOTLPExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	endpoint := viper.GetString("tracing.otlp.endpoint")
+	insecure := viper.GetBool("tracing.otlp.insecure")
+
+	switch protocol := config.StringOrDefault("tracing.otlp.protocol", "grpc"); protocol {
+	case "grpc":
+		var options []otlptracegrpc.Option
+		if endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		if insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, options...)
+	case "http":
+		var options []otlptracehttp.Option
+		if endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(endpoint))
+		}
+		if insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("%w: otlp over %s", ErrUnsupportedExporter, protocol)
+	}
+}
+
+// Middleware starts a server span named after the route, continuing the trace of the caller,
+// and adds the trace ID to the log records of the request.
+func Middleware(route string) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		withTraceID := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+				ctx := logging.WithAttrs(r.Context(), slog.String("trace_id", spanContext.TraceID().String()))
+				r = r.WithContext(ctx)
+			}
+			next.ServeHTTP(w, r)
+		})
+		return otelhttp.NewHandler(withTraceID, route)
+	}
+}
+
+// End records err on the span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
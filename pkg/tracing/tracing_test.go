@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestMiddlewareContinuesTrace(t *testing.T) {
+	viper.Set("tracing.enabled", false)
+	_, err := Init(context.Background())
+	require.NoError(t, err)
+	recorder := newRecorder(t)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var seen trace.SpanContext
+	handler := Middleware("authenticate")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = trace.SpanContextFromContext(r.Context())
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/authenticate", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, traceID, seen.TraceID().String())
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "authenticate", spans[0].Name())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+	assert.True(t, spans[0].Parent().IsRemote())
+}
+
+func TestEnd(t *testing.T) {
+	recorder := newRecorder(t)
+	tracer := otel.Tracer("test")
+
+	_, span := tracer.Start(context.Background(), "ok")
+	End(span, nil)
+	_, span = tracer.Start(context.Background(), "failed")
+	End(span, errors.New("cache unavailable"))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, "cache unavailable", spans[1].Status().Description)
+	assert.Len(t, spans[1].Events(), 1)
+}
+
+func TestInitRejectsUnknownExporter(t *testing.T) {
+	viper.Set("tracing.enabled", true)
+	viper.Set("tracing.exporter", "zipkin")
+	defer viper.Set("tracing.enabled", false)
+	defer viper.Set("tracing.exporter", "")
+
+	_, err := Init(context.Background())
+	assert.ErrorIs(t, err, ErrUnsupportedExporter)
+}